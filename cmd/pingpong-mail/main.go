@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/chrj/smtpd"
 	"go.uber.org/zap"
 
 	"github.com/coronon/pingpong-mail/internal/app"
 	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/dkimsign"
+	"github.com/coronon/pingpong-mail/internal/queue"
+	"github.com/coronon/pingpong-mail/internal/reply"
+	"github.com/coronon/pingpong-mail/internal/resolver"
 	"github.com/coronon/pingpong-mail/internal/util"
 )
 
@@ -46,7 +56,16 @@ func main() {
 
 	// Load configuration
 	config.Cnf = config.ReadConfig(*configPath)
+	resolver.Setup()
 	config.LoadTLS()
+	dkimsign.LoadKeys()
+	reply.LoadTemplates()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Resume delivery of persisted replies
+	queue.Start()
 
 	// Start STMP server
 	server := &smtpd.Server{
@@ -54,7 +73,7 @@ func main() {
 		WelcomeMessage: config.Cnf.SMTPWelcomeMessage,
 
 		MaxRecipients:  1,
-		MaxMessageSize: config.Cnf.MaxMessageSize,
+		MaxMessageSize: config.MaxMessageSize(),
 		TLSConfig:      config.TLSConfig,
 
 		RecipientChecker: app.CheckRecipient,
@@ -66,5 +85,35 @@ func main() {
 	bindAddr := fmt.Sprintf("%v:%v", config.Cnf.BindHost, config.Cnf.BindPort)
 
 	zap.S().Infof("Starting server on: %v", bindAddr)
-	server.ListenAndServe(bindAddr)
+	go func() {
+		err := server.ListenAndServe(bindAddr)
+		if errors.Is(err, smtpd.ErrServerClosed) {
+			return
+		}
+		zap.S().Fatalw("Server stopped", "error", err)
+	}()
+
+	<-ctx.Done()
+	// Restore default signal handling, a second signal terminates immediately
+	stop()
+
+	grace := time.Duration(config.Cnf.ShutdownGracePeriod) * time.Second
+	deadline := time.Now().Add(grace)
+	zap.S().Infow("Shutting down", "grace_period", grace)
+
+	// Stop accepting new sessions, let active sessions finish
+	_ = server.Shutdown(false)
+	sessionsDone := make(chan struct{})
+	go func() {
+		_ = server.Wait()
+		close(sessionsDone)
+	}()
+	select {
+	case <-sessionsDone:
+	case <-time.After(time.Until(deadline)):
+		zap.S().Info("Abandoning active SMTP sessions after shutdown grace period")
+	}
+
+	// Finish deliveries in progress, remaining replies stay on disk
+	queue.Shutdown(time.Until(deadline))
 }
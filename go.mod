@@ -8,6 +8,7 @@ require (
 	github.com/domodwyer/mailyak/v3 v3.6.2
 	github.com/emersion/go-msgauth v0.6.8
 	github.com/google/uuid v1.6.0
+	github.com/miekg/dns v1.1.66
 	go.uber.org/zap v1.27.0
 	golang.org/x/net v0.39.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -16,7 +17,11 @@ require (
 replace github.com/domodwyer/mailyak/v3 => ./vendored/github.com/domodwyer/mailyak/v3
 
 require (
-	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/mod v0.24.0 // indirect
+	golang.org/x/sync v0.13.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/text v0.24.0 // indirect
+	golang.org/x/tools v0.32.0 // indirect
 )
@@ -2,10 +2,14 @@ package app
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/mail"
+	"net/textproto"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/chrj/smtpd"
 	"github.com/domodwyer/mailyak/v3"
@@ -13,19 +17,27 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/delivery"
+	"github.com/coronon/pingpong-mail/internal/dkimsign"
 	"github.com/coronon/pingpong-mail/internal/dmarc"
+	"github.com/coronon/pingpong-mail/internal/queue"
 	"github.com/coronon/pingpong-mail/internal/reply"
+	"github.com/coronon/pingpong-mail/internal/transit"
 	"github.com/coronon/pingpong-mail/internal/util"
 )
 
-// Check valid recipient (if restricted)
+// Maximum length of an outbound error reported in an SMTP reply
+const maxReplyReasonLength = 400
+
+// Check valid recipient (matching a profile or allowed by restriction)
 func CheckRecipient(peer smtpd.Peer, addr string) error {
-	if config.RestrictInboxRegex != nil && !config.RestrictInboxRegex.MatchString(addr) {
+	profile := config.ProfileFor(addr)
+	if profile == nil {
 		zap.S().Debugw("Received email for invalid inbox", "inbox", addr)
 		return config.ErrInvalidRcpt
 	}
 
-	zap.S().Debugw("Received email for valid inbox", "inbox", addr)
+	zap.S().Debugw("Received email for valid inbox", "inbox", addr, "profile", profile.Name)
 
 	return nil
 }
@@ -34,22 +46,54 @@ func CheckRecipient(peer smtpd.Peer, addr string) error {
 func HandleIncoming(peer smtpd.Peer, env smtpd.Envelope) error {
 	var err error
 
+	received := time.Now()
+
+	profile := config.ProfileFor(env.Recipients[0])
+	if profile == nil {
+		return config.ErrInvalidRcpt
+	}
+
+	//? The server enforces the largest size of all profiles
+	if len(env.Data) > profile.MaxMessageSize {
+		zap.S().Debugw("Email exceeds maximum size of profile",
+			"profile", profile.Name,
+			"size", len(env.Data),
+		)
+		return config.ErrMessageTooLarge
+	}
+
 	parsedMail, err := mail.ReadMessage(bytes.NewReader(env.Data))
 	if err != nil {
 		zap.S().Debugw("Can't parse email body", "error", err)
 		return config.ErrCantParseBody
 	}
 
+	//? Accept but never reply to auto-responders, mailing lists and bounces
+	if reason := suppressReason(&env, parsedMail.Header); reason != "" {
+		zap.S().Infow("Not replying to automated email",
+			"sender", env.Sender,
+			"reason", reason,
+		)
+		return nil
+	}
+
+	//? Don't bother checking emails we won't be able to answer anyway
+	if queue.Full() {
+		zap.S().Infow("Delivery backlog is full, rejecting email temporarily")
+		return config.ErrQueueFull
+	}
+
 	// Check subject
+	subject := reply.DecodeSubject(parsedMail.Header.Get("Subject"))
 	zap.S().Debugw("Checking subject",
-		"subject", parsedMail.Header.Get("Subject"),
-		"forced", config.Cnf.ForceSubjectPrefix,
+		"subject", subject,
+		"forced", profile.ForceSubjectPrefix,
 	)
-	if config.Cnf.ForceSubjectPrefix != "" &&
-		!strings.HasPrefix(parsedMail.Header.Get("Subject"), config.Cnf.ForceSubjectPrefix) {
+	if profile.ForceSubjectPrefix != "" &&
+		!strings.HasPrefix(subject, profile.ForceSubjectPrefix) {
 
 		zap.S().Debug("Subject check failed")
-		return fmt.Errorf("please start your subject with '%v'", config.Cnf.ForceSubjectPrefix)
+		return fmt.Errorf("please start your subject with '%v'", profile.ForceSubjectPrefix)
 	}
 
 	// Detmine sender main domain
@@ -72,101 +116,209 @@ func HandleIncoming(peer smtpd.Peer, env smtpd.Envelope) error {
 
 	zap.S().Debugf("Sender domain: %v, From header: %v\n", senderDomain, fromHeaderAddr)
 
+	data := reply.NewTemplateData(&peer, &env, received)
+	data.Profile = profile.Name
+	data.From = fromHeaderAddr
+	data.Subject = subject
+
 	//? To avoid becoming a spammer for people that spoof the sender address for
 	//? us to reply to, we require a DMARC pass! No DMARC -> no reply!
-	if config.Cnf.EnableDmarc {
+	if profile.EnableDmarc {
 		zap.S().Debug("Checking DMARC")
-		err := dmarc.CheckDmarc(&peer, &env, fromHeaderDomain, senderDomain)
+		authResult, err := dmarc.CheckDmarc(&peer, &env, fromHeaderDomain)
 		if err != nil {
 			return err
 		}
+		data.Auth = *authResult
 	}
 
+	// Measure how long the email took to reach us
+	data.Transit = transit.Measure(parsedMail.Header, config.Cnf.ServerName, received)
+	zap.S().Infow("Transit time",
+		"total", data.Transit.Total,
+		"hops", data.Transit.LogHops(),
+	)
+
 	// Handle email
 	zap.S().Debugf("Will handle email :)")
 
-	go handleAccepted(parsedMail, env.Recipients[0], fromHeaderAddr)
-
-	return nil
+	return handleAccepted(profile, parsedMail, env.Data, data)
 }
 
 // Handler for accepted email (passed all checks)
-func handleAccepted(email *mail.Message, incomingRcptAddr string, outgoingRcptAddr string) {
-	// Decide address to reply from
+//
+// The reply is built and persisted in the queue, actual delivery happens in
+// the background. In synchronous mode the reply is delivered right away
+// instead.
+func handleAccepted(
+	profile *config.Profile,
+	email *mail.Message,
+	raw []byte,
+	data *reply.TemplateData,
+) error {
+	outgoingRcptAddr := data.From
+
+	// Decide envelope address to reply from
 	var replyFrom string
-	if config.Cnf.ReplyAddress != "" {
-		replyFrom = config.Cnf.ReplyAddress
+	if profile.ReplyAddress != "" {
+		replyFrom = profile.ReplyAddress
 	} else {
-		replyFrom = incomingRcptAddr
+		replyFrom = data.Recipient
 	}
 
-	// Build new recipients
-	recipients := make([]string, 1)
-	recipients[0] = outgoingRcptAddr
+	// Decide <From:> header, defaults to the envelope address
+	headerFrom := &mail.Address{Address: replyFrom}
+	if profile.ReplyFromAddr != nil {
+		headerFrom = profile.ReplyFromAddr
+	}
+
+	origBody, err := io.ReadAll(email.Body)
+	if err != nil {
+		zap.S().Debugw("Could not read email body", "error", err)
+		return config.ErrCantParseBody
+	}
+	data.RawBody = string(origBody)
+	data.Body = reply.Truncate(
+		profile.ReplyOrigBodyMaxLength,
+		reply.DecodeBody(textproto.MIMEHeader(email.Header), origBody),
+	)
 
 	// Build response subject
-	subject := reply.BuildReplySubject(email.Header.Get("Subject"))
+	subject, err := reply.BuildReplySubject(data)
+	if err != nil {
+		zap.S().Infow("Could not build reply subject", "error", err)
+		return config.ErrReplyNotQueued
+	}
 
 	// Build response message
-	body := reply.BuildReplyBody(email)
-	zap.S().Debugw("Prepared response", "subject", subject, "body", body)
+	body, err := reply.BuildReplyBody(data)
+	if err != nil {
+		zap.S().Infow("Could not build reply message", "error", err)
+		return config.ErrReplyNotQueued
+	}
+
+	// Build optional HTML response message
+	htmlBody, err := reply.BuildReplyHTML(data)
+	if err != nil {
+		zap.S().Infow("Could not build HTML reply message", "error", err)
+		return config.ErrReplyNotQueued
+	}
+	zap.S().Debugw("Prepared response", "subject", subject, "body", body, "html", htmlBody)
 
 	// Build Message-ID
 	msgUUID, err := uuid.NewRandom()
 	if err != nil {
 		zap.S().Debugw("Could not generate random UUID for Message-ID", "error", err)
+		return config.ErrReplyNotQueued
 	}
 	msgID := fmt.Sprintf("<%s@%s>", msgUUID, config.Cnf.ServerName)
 
 	// Build response mail
 	response := mailyak.New("", nil)
-	response.LocalName(config.Cnf.ServerName)
 	response.SetHeader("Message-ID", msgID)
-	response.From(replyFrom)
+	response.SetHeader("Auto-Submitted", "auto-replied")
+	setThreadingHeaders(response, email.Header, profile.ReplyOrigMessageID)
+	response.From(headerFrom.Address)
+	response.FromName(displayName(headerFrom.Name))
+	if profile.ReplyToAddr != nil {
+		response.ReplyTo(profile.ReplyToAddr.String())
+	}
+	if profile.ReplySenderAddr != nil {
+		response.SetHeader("Sender", profile.ReplySenderAddr.String())
+	}
 	response.To(outgoingRcptAddr)
 	response.Subject(subject)
 	response.Plain().Set(body)
-
-	// Find MX server
-	outgoingRcptDomain := util.GetDomainOrFallback(outgoingRcptAddr, "")
-	if outgoingRcptDomain == "" {
-		zap.S().Debugw("Could not determine domain for address", "address", outgoingRcptAddr)
-		return
-	}
-	mxRecords := util.GetMXDomains(outgoingRcptDomain)
-	if len(mxRecords) == 0 {
-		return
-	}
-
-	for _, mx := range mxRecords {
-		for _, port := range config.Cnf.DeliveryPorts {
-			zap.S().Debugw("Trying to send email",
-				"from", replyFrom,
-				"address", outgoingRcptAddr,
-				"domain", outgoingRcptDomain,
-				"mx_host", mx.Host,
-				"mx_pref", mx.Pref,
-				"port", port,
-			)
-
-			conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", mx.Host, port))
-			if err != nil {
-				zap.S().Debugw("Could not dial", "error", err)
-				// Attempt other mx:port combination
-				continue
-			}
-			defer func() { _ = conn.Close() }()
-
-			//? If sending fails we won't retry as that could be seen as 'spammy'
-			//? We know that a connection was established as dialing didn't fail
-			err = mailyak.SmtpExchange(response, conn, mx.Host, true)
-			if err == nil {
-				zap.S().Infow("Sent reply", "to", outgoingRcptAddr)
-			} else {
-				zap.S().Debugw("Error sending reply", "error", err)
-			}
-
-			return
+	if htmlBody != "" {
+		response.HTML().Set(htmlBody)
+		for _, img := range reply.Images {
+			response.AttachInlineWithMimeType(img.Name, bytes.NewReader(img.Data), img.MimeType)
 		}
 	}
+	//? Attached exactly as received, so senders can see what was added on the way
+	if profile.AttachOriginal {
+		response.AttachMessage("original.eml", bytes.NewReader(raw))
+	}
+
+	built, err := response.MimeBuf()
+	if err != nil {
+		zap.S().Debugw("Could not build reply", "error", err)
+		return config.ErrReplyNotQueued
+	}
+
+	// Sign response mail with the key of its From domain (if any)
+	signed, err := dkimsign.Sign(built.Bytes(), util.GetDomainOrFallback(headerFrom.Address, ""))
+	if err != nil {
+		zap.S().Infow("Could not DKIM sign reply", "error", err)
+		return config.ErrReplyNotQueued
+	}
+
+	msg := delivery.Message{
+		ID:   msgUUID.String(),
+		From: replyFrom,
+		To:   outgoingRcptAddr,
+		Data: signed,
+	}
+
+	if config.Cnf.SynchronousReply {
+		return deliverSynchronously(&msg)
+	}
+
+	err = queue.Enqueue(msg)
+	if errors.Is(err, queue.ErrFull) {
+		zap.S().Infow("Delivery backlog is full, rejecting email temporarily")
+		return config.ErrQueueFull
+	}
+	if err != nil {
+		zap.S().Infow("Could not queue reply", "error", err)
+		return config.ErrReplyNotQueued
+	}
+
+	return nil
+}
+
+// Deliver `msg` before answering the incoming email
+//
+// Failures are reported to the sender of the incoming email, so they can see
+// why the round trip failed right away: temporary failures with 451, permanent
+// ones with 554.
+func deliverSynchronously(msg *delivery.Message) error {
+	timeout := time.Duration(config.Cnf.SynchronousTimeout) * time.Second
+
+	err := queue.DeliverNow(timeout, msg)
+	if err == nil {
+		zap.S().Infow("Sent reply", "to", msg.To)
+		return nil
+	}
+
+	zap.S().Infow("Could not deliver reply synchronously", "to", msg.To, "error", err)
+
+	code := 554
+	if delivery.IsTemporary(err) {
+		code = 451
+	}
+	//? The outbound error ends up in a single reply line
+	reason := strings.Join(strings.Fields(err.Error()), " ")
+	reason = reply.Truncate(maxReplyReasonLength, reason)
+
+	return smtpd.Error{
+		Code:    code,
+		Message: "Reply could not be delivered: " + reason,
+	}
+}
+
+// Display name as it may appear in a header
+//
+// ASCII names containing special characters are quoted (RFC 5322 §3.4),
+// non-ASCII names are encoded by mailyak.
+func displayName(name string) string {
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool { return r >= utf8.RuneSelf }) {
+		return name
+	}
+
+	if !strings.ContainsAny(name, `()<>[]:;@\,."`) {
+		return name
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
 }
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/chrj/smtpd"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Reason why no reply must be sent for an email, empty if a reply is fine
+//
+// Follows the recommendations of RFC 3834 §2 to never respond to automatically
+// generated messages, mailing lists or bounces. Replying to those would risk
+// mail loops with other auto-responders (including other instances of us).
+func suppressReason(env *smtpd.Envelope, header mail.Header) string {
+	//? Bounces and other notifications are sent with a null reverse-path
+	if env.Sender == "" || env.Sender == "<>" {
+		return "empty envelope sender"
+	}
+
+	autoSubmitted := strings.TrimSpace(header.Get("Auto-Submitted"))
+	if autoSubmitted != "" && !strings.EqualFold(autoSubmitted, "no") {
+		return "Auto-Submitted: " + autoSubmitted
+	}
+
+	switch precedence := strings.ToLower(strings.TrimSpace(header.Get("Precedence"))); precedence {
+	case "bulk", "list", "junk":
+		return "Precedence: " + precedence
+	}
+
+	if header.Get("List-Id") != "" {
+		return "List-Id present"
+	}
+
+	//? A message referencing one of our replies is a response to us
+	ownSuffix := "@" + strings.ToLower(config.Cnf.ServerName) + ">"
+	for _, key := range []string{"References", "In-Reply-To"} {
+		for _, value := range header[key] {
+			for _, id := range strings.Fields(value) {
+				if strings.HasSuffix(strings.ToLower(id), ownSuffix) {
+					return key + " contains our own Message-ID"
+				}
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/chrj/smtpd"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+func TestSuppressReason(t *testing.T) {
+	prev := config.Cnf.ServerName
+	config.Cnf.ServerName = "Mail.Test"
+	t.Cleanup(func() { config.Cnf.ServerName = prev })
+
+	tests := []struct {
+		name     string
+		sender   string
+		header   mail.Header
+		suppress bool
+	}{
+		{"regular email", "tester@example.com", mail.Header{"Subject": {"PING"}}, false},
+		{"null sender", "", mail.Header{}, true},
+		{"bracketed null sender", "<>", mail.Header{}, true},
+		{"auto-replied", "tester@example.com", mail.Header{"Auto-Submitted": {"auto-replied"}}, true},
+		{"auto-generated", "tester@example.com", mail.Header{"Auto-Submitted": {" Auto-Generated "}}, true},
+		{"explicitly not automatic", "tester@example.com", mail.Header{"Auto-Submitted": {"No"}}, false},
+		{"bulk", "tester@example.com", mail.Header{"Precedence": {"Bulk"}}, true},
+		{"list precedence", "tester@example.com", mail.Header{"Precedence": {"list"}}, true},
+		{"junk", "tester@example.com", mail.Header{"Precedence": {"junk"}}, true},
+		{"first-class precedence", "tester@example.com", mail.Header{"Precedence": {"first-class"}}, false},
+		{"mailing list", "tester@example.com", mail.Header{"List-Id": {"<list.example.com>"}}, true},
+		{"reply to us", "tester@example.com", mail.Header{"In-Reply-To": {"<abc@mail.test>"}}, true},
+		{
+			"references us",
+			"tester@example.com",
+			mail.Header{"References": {"<root@example.com> <abc@MAIL.TEST>"}},
+			true,
+		},
+		{"similar domain", "tester@example.com", mail.Header{"In-Reply-To": {"<abc@othermail.test>"}}, false},
+		{"references others", "tester@example.com", mail.Header{"References": {"<abc@example.com>"}}, false},
+	}
+
+	for _, test := range tests {
+		env := &smtpd.Envelope{Sender: test.sender}
+		reason := suppressReason(env, test.header)
+		if got := reason != ""; got != test.suppress {
+			t.Errorf("%v: suppressReason = %q, want suppressed %v", test.name, reason, test.suppress)
+		}
+	}
+}
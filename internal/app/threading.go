@@ -0,0 +1,111 @@
+package app
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/domodwyer/mailyak/v3"
+)
+
+// Limits of the message identifiers carried over into our headers
+const (
+	// Number of identifiers in `References`
+	maxReferences = 20
+	// Length of a single identifier
+	maxMsgIDLength = 250
+	// Length of the `References` value, keeping the header within the line
+	// length limit of RFC 5322 §2.1.1 (998 characters)
+	maxReferencesLength = 998 - len("References: ")
+)
+
+// Set the headers identifying `response` as a reply to the email with `header`
+//
+// Follows RFC 5322 §3.6.4: `In-Reply-To` holds the Message-ID of the received
+// email, `References` its references (or In-Reply-To) followed by its
+// Message-ID. With `originalID` it is also set as
+// `X-PingPong-Original-Message-ID`.
+func setThreadingHeaders(response *mailyak.MailYak, header mail.Header, originalID bool) {
+	msgID := firstMsgID(header.Get("Message-ID"))
+
+	refs := msgIDs(header.Get("References"))
+	if len(refs) == 0 {
+		refs = msgIDs(header.Get("In-Reply-To"))
+	}
+	if msgID != "" {
+		refs = append(refs, msgID)
+	}
+	refs = limitReferences(refs)
+
+	//? Identifiers are plain ASCII, so `SetHeader` never Q-encodes them
+	if msgID != "" {
+		response.SetHeader("In-Reply-To", msgID)
+		if originalID {
+			response.SetHeader("X-PingPong-Original-Message-ID", msgID)
+		}
+	}
+	if len(refs) > 0 {
+		response.SetHeader("References", strings.Join(refs, " "))
+	}
+}
+
+// Shorten `refs` to `maxReferences` identifiers and `maxReferencesLength`
+//
+// Keeps the first (thread root) and the most recent identifiers.
+func limitReferences(refs []string) []string {
+	if len(refs) > maxReferences {
+		refs = append(refs[:1], refs[len(refs)-maxReferences+1:]...)
+	}
+
+	length := len(strings.Join(refs, " "))
+	for len(refs) > 1 && length > maxReferencesLength {
+		length -= len(refs[1]) + 1
+		refs = append(refs[:1], refs[2:]...)
+	}
+
+	return refs
+}
+
+// All message identifiers (`<id-left@id-right>`) contained in `value`
+//
+// Anything outside of angle brackets (comments, phrases) is ignored, as are
+// identifiers longer than `maxMsgIDLength` or containing whitespace, control
+// or non-ASCII characters.
+func msgIDs(value string) []string {
+	var ids []string
+
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return ids
+		}
+
+		id := value[start : start+end+1]
+		value = value[start+end+1:]
+
+		if len(id) <= maxMsgIDLength && strings.Contains(id, "@") && !strings.ContainsFunc(id, isUnsafeIDRune) {
+			ids = append(ids, id)
+		}
+	}
+}
+
+// First message identifier in `value`, empty if there is none
+func firstMsgID(value string) string {
+	ids := msgIDs(value)
+	if len(ids) == 0 {
+		return ""
+	}
+
+	return ids[0]
+}
+
+// Whether `r` must not appear in a message identifier we copy into our headers
+//
+// Identifiers are ASCII only (RFC 5322 §3.6.4), anything else would have to be
+// encoded, which is not permitted in these headers.
+func isUnsafeIDRune(r rune) bool {
+	return r <= ' ' || r >= 0x7f
+}
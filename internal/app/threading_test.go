@@ -0,0 +1,61 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgIDs(t *testing.T) {
+	long := "<" + strings.Repeat("a", maxMsgIDLength) + "@example.com>"
+
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"<a@example.com>", []string{"<a@example.com>"}},
+		{"<a@example.com> (comment) <b@example.com>", []string{"<a@example.com>", "<b@example.com>"}},
+		{"Phrase <a@example.com>\r\n\t<b@example.com>", []string{"<a@example.com>", "<b@example.com>"}},
+		{"<no-at-sign> <a b@example.com> <a\x00@example.com>", nil},
+		{"<grüße@example.com> <a@example.com>", []string{"<a@example.com>"}},
+		{"<a@example.com> " + long, []string{"<a@example.com>"}},
+		{"<unterminated@example.com", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := msgIDs(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("msgIDs(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLimitReferences(t *testing.T) {
+	ids := func(n, length int) []string {
+		refs := make([]string, n)
+		for i := range refs {
+			refs[i] = "<" + strings.Repeat(string(rune('a'+i%26)), length-len("<@x>")) + "@x>"
+		}
+		return refs
+	}
+
+	refs := ids(30, 10)
+	got := limitReferences(append([]string(nil), refs...))
+	if len(got) != maxReferences || got[0] != refs[0] || got[len(got)-1] != refs[29] {
+		t.Errorf("limitReferences kept %q, want root and the most recent", got)
+	}
+
+	refs = ids(10, maxMsgIDLength)
+	got = limitReferences(append([]string(nil), refs...))
+	if length := len(strings.Join(got, " ")); length > maxReferencesLength {
+		t.Errorf("References is %v characters long, want at most %v", length, maxReferencesLength)
+	}
+	if len(got) != 3 || got[0] != refs[0] || got[2] != refs[9] {
+		t.Errorf("limitReferences kept %v identifiers, want root and the most recent", len(got))
+	}
+
+	refs = ids(3, 10)
+	if got := limitReferences(append([]string(nil), refs...)); !reflect.DeepEqual(got, refs) {
+		t.Errorf("limitReferences(%q) = %q, want unchanged", refs, got)
+	}
+}
@@ -2,9 +2,14 @@ package config
 
 import (
 	"errors"
+	"net"
+	"net/mail"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/chrj/smtpd"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -18,30 +23,211 @@ var (
 	ErrSPFCantValidate   = errors.New("SPF can not be validated")
 	ErrDKIMCantValidate  = errors.New("DKIM can not be validated")
 	ErrDMARCFailed       = errors.New("DMARC failed or sender could not be validated")
+	ErrReplyNotQueued    = smtpd.Error{Code: 451, Message: "Reply could not be queued, try again later"}
+	ErrMessageTooLarge   = smtpd.Error{Code: 552, Message: "Message exceeds maximum size for this inbox"}
+	ErrQueueFull         = smtpd.Error{Code: 451, Message: "Too many replies pending, try again later"}
+	ErrNullMX            = errors.New("Domain does not accept mail (null MX)")
+	ErrNoMailHost        = errors.New("Domain has neither MX nor address records")
+)
+
+// Supported values for `relay_tls`
+const (
+	RelayTLSStartTLS = "starttls"
+	RelayTLSImplicit = "tls"
+	RelayTLSNone     = "none"
+)
+
+// Supported values for `relay_auth`
+const (
+	RelayAuthPlain   = "plain"
+	RelayAuthLogin   = "login"
+	RelayAuthCRAMMD5 = "cram-md5"
+)
+
+// Supported values for `outbound_address_family`
+const (
+	AddressFamilyAny        = "any"
+	AddressFamilyPreferIPv4 = "prefer-ipv4"
+	AddressFamilyPreferIPv6 = "prefer-ipv6"
+	AddressFamilyIPv4       = "ipv4"
+	AddressFamilyIPv6       = "ipv6"
+)
+
+// Supported values for `outbound_tls_policy`
+const (
+	TLSPolicyNone                   = "none"
+	TLSPolicyOpportunistic          = "opportunistic"
+	TLSPolicyOpportunisticPlaintext = "opportunistic-plaintext"
+	TLSPolicyRequire                = "require"
 )
 
 // Current configuration of the application
 var Cnf Config
 var RestrictInboxRegex *regexp.Regexp
 
+// Names of inline images end up in MIME headers and `cid:` URLs
+var inlineImageNameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
 type Config struct {
-	BindHost                string `yaml:"bind_host"`
-	BindPort                int    `yaml:"bind_port"`
-	TLSCertPath             string `yaml:"tls_cert_path,omitempty"`
-	TLSKeyPath              string `yaml:"tls_key_path,omitempty"`
-	TLSCacheDuration        int    `yaml:"tls_cache_duration,omitempty"`
-	TLSCacheExpiryThreshold int    `yaml:"tls_cache_expiry_threshold,omitempty"`
-	SMTPWelcomeMessage      string `yaml:"smtp_welcome_message"`
-	ServerName              string `yaml:"server_name"`
-	DeliveryPorts           []int  `yaml:"delivery_ports"`
-	RestrictInbox           string `yaml:"restrict_inbox"`
-	ForceSubjectPrefix      string `yaml:"force_subject_prefix"`
-	MaxMessageSize          int    `yaml:"max_message_size"`
-	EnableDmarc             bool   `yaml:"enable_dmarc"`
-	ReplyAddress            string `yaml:"reply_address"`
-	ReplyFrom               string `yaml:"reply_from"`
-	ReplySubject            string `yaml:"reply_subject"`
-	ReplyMessage            string `yaml:"reply_message"`
+	// Default profile for all inboxes not matching one of `Profiles`
+	Profile `yaml:",inline"`
+
+	BindHost                string    `yaml:"bind_host"`
+	BindPort                int       `yaml:"bind_port"`
+	TLSCertPath             string    `yaml:"tls_cert_path,omitempty"`
+	TLSKeyPath              string    `yaml:"tls_key_path,omitempty"`
+	TLSCacheDuration        int       `yaml:"tls_cache_duration,omitempty"`
+	TLSCacheExpiryThreshold int       `yaml:"tls_cache_expiry_threshold,omitempty"`
+	SMTPWelcomeMessage      string    `yaml:"smtp_welcome_message"`
+	ServerName              string    `yaml:"server_name"`
+	DeliveryPorts           []int     `yaml:"delivery_ports"`
+	RestrictInbox           string    `yaml:"restrict_inbox"`
+	QueueDir                string    `yaml:"queue_dir"`
+	QueueRetryMin           int       `yaml:"queue_retry_min"`
+	QueueRetryMax           int       `yaml:"queue_retry_max"`
+	QueueMaxAge             int       `yaml:"queue_max_age"`
+	DeliveryWorkers         int       `yaml:"delivery_workers"`
+	DeliveryWorkersPerMX    int       `yaml:"delivery_workers_per_mx"`
+	DeliveryBacklog         int       `yaml:"delivery_backlog"`
+	ShutdownGracePeriod     int       `yaml:"shutdown_grace_period"`
+	SynchronousReply        bool      `yaml:"synchronous_reply"`
+	SynchronousTimeout      int       `yaml:"synchronous_timeout"`
+	EnableMTASTS            bool      `yaml:"enable_mta_sts"`
+	EnableDANE              bool      `yaml:"enable_dane"`
+	RelayHost               string    `yaml:"relay_host"`
+	RelayTLS                string    `yaml:"relay_tls"`
+	RelayAuth               string    `yaml:"relay_auth"`
+	RelayUsername           string    `yaml:"relay_username"`
+	RelayPasswordFile       string    `yaml:"relay_password_file"`
+	DKIMKeys                []DKIMKey `yaml:"dkim_keys"`
+	DKIMHeaders             []string  `yaml:"dkim_headers"`
+	ConnectTimeout          int       `yaml:"connect_timeout"`
+	CommandTimeout          int       `yaml:"command_timeout"`
+	DeliveryTimeout         int       `yaml:"delivery_timeout"`
+	OutboundHeloName        string    `yaml:"outbound_helo_name"`
+	OutboundSourceAddresses []string  `yaml:"outbound_source_addresses"`
+	OutboundAddressFamily   string    `yaml:"outbound_address_family"`
+	DNSNameservers          []string  `yaml:"dns_nameservers"`
+	DNSOverTLS              bool      `yaml:"dns_over_tls"`
+	DNSTLSServerName        string    `yaml:"dns_tls_server_name"`
+	DNSTimeout              int       `yaml:"dns_timeout"`
+	DNSCacheSize            int       `yaml:"dns_cache_size"`
+	OutboundTLSPolicy       string    `yaml:"outbound_tls_policy"`
+
+	OutboundTLSPolicyDomains map[string]string `yaml:"outbound_tls_policy_domains"`
+	ReplyInlineImages        []InlineImage     `yaml:"reply_inline_images"`
+	Profiles                 []InboxProfile    `yaml:"-"`
+
+	// Raw `profiles`, decoded on top of the default profile
+	RawProfiles []yaml.MapSlice `yaml:"profiles"`
+
+	// Read from `RelayPasswordFile`
+	RelayPassword string `yaml:"-"`
+	// Parsed from `RelayHost`
+	RelayHostname string `yaml:"-"`
+	RelayPort     int    `yaml:"-"`
+	// Parsed from `OutboundSourceAddresses`
+	OutboundSourceIPs []net.IP `yaml:"-"`
+}
+
+// Name of the default profile
+const DefaultProfileName = "default"
+
+// Size limit of `smtpd`, applied if `max_message_size` is not set
+const defaultMaxMessageSize = 10240000
+
+// Number of characters of the received text in replies if not configured
+const defaultReplyOrigBodyMaxLength = 10000
+
+// Checks and reply settings applied to an inbox
+type Profile struct {
+	// Set by `ReadConfig`
+	Name string `yaml:"-"`
+
+	ForceSubjectPrefix string `yaml:"force_subject_prefix"`
+	MaxMessageSize     int    `yaml:"max_message_size"`
+	EnableDmarc        bool   `yaml:"enable_dmarc"`
+	ReplyAddress       string `yaml:"reply_address"`
+	ReplyFrom          string `yaml:"reply_from"`
+	ReplyTo            string `yaml:"reply_to"`
+	ReplySender        string `yaml:"reply_sender"`
+	ReplySubject       string `yaml:"reply_subject"`
+	ReplyMessage       string `yaml:"reply_message"`
+	ReplyMessageHTML   string `yaml:"reply_message_html"`
+
+	ReplyOrigBodyMaxLength int  `yaml:"reply_original_body_max_length"`
+	ReplyOrigMessageID     bool `yaml:"reply_original_message_id_header"`
+	AttachOriginal         bool `yaml:"attach_original"`
+
+	// Parsed from `ReplyFrom`, `ReplyTo` and `ReplySender`, nil if not set
+	ReplyFromAddr   *mail.Address `yaml:"-"`
+	ReplyToAddr     *mail.Address `yaml:"-"`
+	ReplySenderAddr *mail.Address `yaml:"-"`
+}
+
+// Profile applied to inboxes matching `Inbox` or `Address`
+type InboxProfile struct {
+	Name string `yaml:"name"`
+	// Regular expression matching the inboxes
+	Inbox string `yaml:"inbox"`
+	// Single inbox, compared case-insensitively
+	Address string `yaml:"address"`
+
+	Profile `yaml:",inline"`
+
+	inboxRegex *regexp.Regexp
+}
+
+// Whether the profile applies to the inbox `addr`
+func (p *InboxProfile) Matches(addr string) bool {
+	if p.Address != "" && strings.EqualFold(p.Address, addr) {
+		return true
+	}
+
+	return p.inboxRegex != nil && p.inboxRegex.MatchString(addr)
+}
+
+// Profile applied to the inbox `addr`
+//
+// Profiles are matched in order, the default profile applies if none matches.
+// Returns nil if the inbox matches no profile and is not allowed by
+// `restrict_inbox`.
+func ProfileFor(addr string) *Profile {
+	for i := range Cnf.Profiles {
+		if Cnf.Profiles[i].Matches(addr) {
+			return &Cnf.Profiles[i].Profile
+		}
+	}
+
+	if RestrictInboxRegex != nil && !RestrictInboxRegex.MatchString(addr) {
+		return nil
+	}
+
+	return &Cnf.Profile
+}
+
+// Largest message size accepted by any profile
+func MaxMessageSize() int {
+	size := Cnf.MaxMessageSize
+	for _, p := range Cnf.Profiles {
+		size = max(size, p.MaxMessageSize)
+	}
+
+	return size
+}
+
+// Image embedded in HTML replies, referenced as `cid:<Name>`
+type InlineImage struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+// Key used to DKIM sign replies sent from `Domain`
+type DKIMKey struct {
+	Domain         string   `yaml:"domain"`
+	Selector       string   `yaml:"selector"`
+	PrivateKeyPath string   `yaml:"private_key_path"`
+	Headers        []string `yaml:"headers,omitempty"`
 }
 
 // Read and parse a yaml config at path
@@ -58,6 +244,107 @@ func ReadConfig(path string) Config {
 		zap.S().Fatalf("Error parsing config: %v", err)
 	}
 
+	// Handle queue defaults
+	if c.QueueDir == "" {
+		c.QueueDir = "queue"
+	}
+	if c.QueueRetryMin <= 0 {
+		c.QueueRetryMin = 60
+	}
+	if c.QueueRetryMax <= 0 {
+		c.QueueRetryMax = 3600
+	}
+	if c.QueueRetryMax < c.QueueRetryMin {
+		c.QueueRetryMax = c.QueueRetryMin
+	}
+	if c.QueueMaxAge <= 0 {
+		c.QueueMaxAge = 86400
+	}
+	if c.DeliveryWorkers <= 0 {
+		c.DeliveryWorkers = 8
+	}
+	if c.DeliveryWorkersPerMX <= 0 {
+		c.DeliveryWorkersPerMX = 2
+	}
+	if c.DeliveryBacklog <= 0 {
+		c.DeliveryBacklog = 1000
+	}
+	if c.ShutdownGracePeriod <= 0 {
+		c.ShutdownGracePeriod = 30
+	}
+	if c.SynchronousTimeout <= 0 {
+		c.SynchronousTimeout = 60
+	}
+
+	// Handle timeout defaults
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = 30
+	}
+	if c.CommandTimeout <= 0 {
+		c.CommandTimeout = 300
+	}
+	if c.DeliveryTimeout <= 0 {
+		c.DeliveryTimeout = 600
+	}
+
+	// Handle DNS defaults
+	if c.DNSTimeout <= 0 {
+		c.DNSTimeout = 5
+	}
+	//? Negative sizes disable the cache
+	if c.DNSCacheSize == 0 {
+		c.DNSCacheSize = 1024
+	}
+
+	// Handle outbound identity
+	if c.OutboundHeloName == "" {
+		c.OutboundHeloName = c.ServerName
+	}
+	if c.OutboundAddressFamily == "" {
+		c.OutboundAddressFamily = AddressFamilyAny
+	}
+	switch c.OutboundAddressFamily {
+	case AddressFamilyAny, AddressFamilyPreferIPv4, AddressFamilyPreferIPv6, AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		zap.S().Fatalw("Invalid outbound address family",
+			"outbound_address_family", c.OutboundAddressFamily,
+		)
+	}
+	for _, addr := range c.OutboundSourceAddresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			zap.S().Fatalw("Invalid outbound source address", "address", addr)
+		}
+		c.OutboundSourceIPs = append(c.OutboundSourceIPs, ip)
+	}
+
+	// Handle outbound TLS policies
+	if c.OutboundTLSPolicy == "" {
+		c.OutboundTLSPolicy = TLSPolicyOpportunistic
+	}
+	validateTLSPolicy(c.OutboundTLSPolicy)
+	domainPolicies := make(map[string]string, len(c.OutboundTLSPolicyDomains))
+	for domain, policy := range c.OutboundTLSPolicyDomains {
+		validateTLSPolicy(policy)
+		domainPolicies[strings.ToLower(domain)] = policy
+	}
+	c.OutboundTLSPolicyDomains = domainPolicies
+
+	// Handle inline images
+	for _, img := range c.ReplyInlineImages {
+		if !inlineImageNameRegex.MatchString(img.Name) || img.Path == "" {
+			zap.S().Fatalw("Invalid inline image, name may only contain letters, digits, '.', '_' and '-'",
+				"name", img.Name,
+				"path", img.Path,
+			)
+		}
+	}
+
+	// Handle relay
+	if c.RelayHost != "" {
+		readRelayConfig(&c)
+	}
+
 	// Handle RestrictInboxRegex
 	if c.RestrictInbox != "" {
 		RestrictInboxRegex, err = regexp.Compile(c.RestrictInbox)
@@ -69,5 +356,170 @@ func ReadConfig(path string) Config {
 		}
 	}
 
+	// Handle profiles
+	c.Profile.Name = DefaultProfileName
+	applyProfileDefaults(&c.Profile)
+	readProfiles(&c)
+	readReplyAddresses(&c.Profile)
+	for i := range c.Profiles {
+		applyProfileDefaults(&c.Profiles[i].Profile)
+		readReplyAddresses(&c.Profiles[i].Profile)
+	}
+
 	return c
 }
+
+// Validate the smart-host relay settings and read its password
+func readRelayConfig(c *Config) {
+	host, portStr, err := net.SplitHostPort(c.RelayHost)
+	if err != nil || host == "" {
+		zap.S().Fatalw("Invalid relay host, expected host:port",
+			"relay_host", c.RelayHost,
+			"error", err,
+		)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		zap.S().Fatalw("Invalid relay port", "relay_host", c.RelayHost)
+	}
+	c.RelayHostname = host
+	c.RelayPort = port
+
+	if c.RelayTLS == "" {
+		c.RelayTLS = RelayTLSStartTLS
+	}
+	switch c.RelayTLS {
+	case RelayTLSStartTLS, RelayTLSImplicit, RelayTLSNone:
+	default:
+		zap.S().Fatalw("Invalid relay TLS mode", "relay_tls", c.RelayTLS)
+	}
+
+	switch c.RelayAuth {
+	case "":
+		return
+	case RelayAuthPlain, RelayAuthLogin, RelayAuthCRAMMD5:
+	default:
+		zap.S().Fatalw("Invalid relay authentication mechanism", "relay_auth", c.RelayAuth)
+	}
+	if c.RelayUsername == "" {
+		zap.S().Fatalw("Relay authentication requires a username", "relay_auth", c.RelayAuth)
+	}
+	//? Credentials are only sent in the clear to the local host, like `net/smtp`
+	if c.RelayTLS == RelayTLSNone && host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		zap.S().Fatalw("Relay authentication requires TLS unless the relay is localhost",
+			"relay_host", c.RelayHost,
+			"relay_tls", c.RelayTLS,
+		)
+	}
+
+	password, err := os.ReadFile(c.RelayPasswordFile)
+	if err != nil {
+		zap.S().Fatalw("Error reading relay password",
+			"relay_password_file", c.RelayPasswordFile,
+			"error", err,
+		)
+	}
+	c.RelayPassword = strings.TrimRight(string(password), "\r\n")
+}
+
+// Decode the inbox profiles, unset settings are inherited from the default
+// profile
+func readProfiles(c *Config) {
+	names := map[string]bool{DefaultProfileName: true}
+
+	for _, raw := range c.RawProfiles {
+		//? Decoding on top of a copy of the default keeps unset settings
+		data, err := yaml.Marshal(raw)
+		if err != nil {
+			zap.S().Fatalw("Error parsing profile", "error", err)
+		}
+		p := InboxProfile{Profile: c.Profile}
+		if err := yaml.Unmarshal(data, &p); err != nil {
+			zap.S().Fatalw("Error parsing profile", "error", err)
+		}
+
+		if p.Name == "" || names[p.Name] {
+			zap.S().Fatalw("Profiles require a unique name", "name", p.Name)
+		}
+		names[p.Name] = true
+		p.Profile.Name = p.Name
+
+		if p.Inbox == "" && p.Address == "" {
+			zap.S().Fatalw("Profile matches no inbox, set `inbox` or `address`", "profile", p.Name)
+		}
+		if p.Inbox != "" {
+			p.inboxRegex, err = regexp.Compile(p.Inbox)
+			if err != nil {
+				zap.S().Fatalw("Error parsing profile inbox regex",
+					"profile", p.Name,
+					"inbox", p.Inbox,
+					"error", err,
+				)
+			}
+		}
+
+		c.Profiles = append(c.Profiles, p)
+	}
+}
+
+// Apply defaults to the settings of `p` that are not set
+func applyProfileDefaults(p *Profile) {
+	//? 0 means the `smtpd` default, which has to be explicit to compare limits
+	if p.MaxMessageSize <= 0 {
+		p.MaxMessageSize = defaultMaxMessageSize
+	}
+	if p.ReplyOrigBodyMaxLength <= 0 {
+		p.ReplyOrigBodyMaxLength = defaultReplyOrigBodyMaxLength
+	}
+}
+
+// Validate the addresses replies of `p` are sent from
+//
+// `reply_address` is used as envelope sender and must be a plain RFC 5321
+// address, the header addresses are RFC 5322 addresses with an optional
+// display name.
+func readReplyAddresses(p *Profile) {
+	if p.ReplyAddress != "" {
+		addr, err := mail.ParseAddress(p.ReplyAddress)
+		if err != nil || addr.Name != "" || addr.Address != p.ReplyAddress {
+			zap.S().Fatalw("Invalid reply address, expected a plain address like `check@example.com`",
+				"profile", p.Name,
+				"reply_address", p.ReplyAddress,
+			)
+		}
+	}
+
+	for _, field := range []struct {
+		key   string
+		value string
+		addr  **mail.Address
+	}{
+		{"reply_from", p.ReplyFrom, &p.ReplyFromAddr},
+		{"reply_to", p.ReplyTo, &p.ReplyToAddr},
+		{"reply_sender", p.ReplySender, &p.ReplySenderAddr},
+	} {
+		*field.addr = nil
+		if field.value == "" {
+			continue
+		}
+
+		addr, err := mail.ParseAddress(field.value)
+		if err != nil {
+			zap.S().Fatalw("Invalid reply header address",
+				"profile", p.Name,
+				field.key, field.value,
+				"error", err,
+			)
+		}
+		*field.addr = addr
+	}
+}
+
+// Abort if `policy` is not a supported outbound TLS policy
+func validateTLSPolicy(policy string) {
+	switch policy {
+	case TLSPolicyNone, TLSPolicyOpportunistic, TLSPolicyOpportunisticPlaintext, TLSPolicyRequire:
+	default:
+		zap.S().Fatalw("Invalid outbound TLS policy", "policy", policy)
+	}
+}
@@ -0,0 +1,147 @@
+package dane
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/resolver"
+)
+
+// Certificate usages supported for SMTP (RFC 7672 section 3.1)
+const (
+	usageDANETA = 2
+	usageDANEEE = 3
+)
+
+var ErrNoMatch = errors.New("certificate does not match any TLSA record")
+
+// Lookup usable TLSA records for the SMTP server at `host:port`
+//
+// Records are only returned if the resolver reports the answer as DNSSEC
+// authenticated, otherwise DANE does not apply and nil is returned. Records
+// with usages other than DANE-TA and DANE-EE are ignored (RFC 7672 section 3.1).
+func Lookup(ctx context.Context, host string, port int) ([]*dns.TLSA, error) {
+	name := fmt.Sprintf("_%d._tcp.%s", port, dns.Fqdn(host))
+
+	tlsaRecords, authenticated, err := resolver.Default.LookupTLSA(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !authenticated {
+		zap.S().Debugw("TLSA answer not DNSSEC authenticated", "name", name)
+		return nil, nil
+	}
+
+	records := make([]*dns.TLSA, 0, len(tlsaRecords))
+	for _, tlsa := range tlsaRecords {
+		if tlsa.Usage == usageDANETA || tlsa.Usage == usageDANEEE {
+			records = append(records, tlsa)
+		}
+	}
+
+	return records, nil
+}
+
+// Build a TLS config authenticating `serverName` by `records` instead of WebPKI
+func TLSConfig(serverName string, records []*dns.TLSA) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// The chain is verified against the TLSA records in `VerifyConnection`
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return Verify(state, serverName, records)
+		},
+	}
+}
+
+// Verify the certificates presented in `state` against `records`
+//
+// DANE-EE records match the leaf certificate without any further name or expiry
+// checks (RFC 7672 section 3.1.1). DANE-TA records match a certificate of the
+// presented chain which is then used as trust anchor for regular chain, name
+// and expiry validation (RFC 7672 section 3.1.2).
+func Verify(state tls.ConnectionState, serverName string, records []*dns.TLSA) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	serverName = strings.TrimSuffix(serverName, ".")
+
+	for _, record := range records {
+		switch record.Usage {
+		case usageDANEEE:
+			if match(record, certs[0]) {
+				return nil
+			}
+		case usageDANETA:
+			for _, anchor := range certs {
+				if !match(record, anchor) {
+					continue
+				}
+
+				roots := x509.NewCertPool()
+				roots.AddCert(anchor)
+				intermediates := x509.NewCertPool()
+				for _, cert := range certs[1:] {
+					intermediates.AddCert(cert)
+				}
+
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       serverName,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+				zap.S().Debugw("DANE-TA chain validation failed", "server", serverName, "error", err)
+			}
+		}
+	}
+
+	return ErrNoMatch
+}
+
+// Check whether `cert` matches the association data of `record`
+func match(record *dns.TLSA, cert *x509.Certificate) bool {
+	var data []byte
+	switch record.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch record.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(record.Certificate)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(data, expected)
+}
@@ -0,0 +1,147 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Create a certificate for `names` signed by `parent`, self-signed if nil
+func newCert(t *testing.T, cn string, names []string, isCA bool, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+
+	return cert, key
+}
+
+// TLSA record of `usage` associating `cert` using `selector` and `matchingType`
+func newTLSA(cert *x509.Certificate, usage, selector, matchingType uint8) *dns.TLSA {
+	data := cert.Raw
+	if selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+
+	switch matchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+
+	return &dns.TLSA{
+		Usage:        usage,
+		Selector:     selector,
+		MatchingType: matchingType,
+		Certificate:  hex.EncodeToString(data),
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cert, _ := newCert(t, "mx.example.com", []string{"mx.example.com"}, false, time.Now().Add(time.Hour), nil, nil)
+	other, _ := newCert(t, "mx.example.com", []string{"mx.example.com"}, false, time.Now().Add(time.Hour), nil, nil)
+
+	for selector := range uint8(2) {
+		for matchingType := range uint8(3) {
+			record := newTLSA(cert, usageDANEEE, selector, matchingType)
+			if !match(record, cert) {
+				t.Errorf("%v %v: match = false, want true", selector, matchingType)
+			}
+			if match(record, other) {
+				t.Errorf("%v %v: match of other certificate = true, want false", selector, matchingType)
+			}
+		}
+	}
+
+	invalid := map[string]*dns.TLSA{
+		"unknown selector":      {Selector: 2, MatchingType: 0, Certificate: hex.EncodeToString(cert.Raw)},
+		"unknown matching type": {Selector: 0, MatchingType: 3, Certificate: hex.EncodeToString(cert.Raw)},
+		"invalid hex":           {Selector: 0, MatchingType: 0, Certificate: "zz"},
+		"truncated digest":      {Selector: 1, MatchingType: 1, Certificate: newTLSA(cert, 3, 1, 1).Certificate[:32]},
+	}
+	for name, record := range invalid {
+		if match(record, cert) {
+			t.Errorf("%v: match = true, want false", name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Minute)
+
+	ca, caKey := newCert(t, "Test CA", nil, true, valid, nil, nil)
+	leaf, _ := newCert(t, "mx.example.com", []string{"mx.example.com"}, false, valid, ca, caKey)
+	expiredLeaf, _ := newCert(t, "mx.example.com", []string{"mx.example.com"}, false, expired, ca, caKey)
+	otherCA, _ := newCert(t, "Other CA", nil, true, valid, nil, nil)
+
+	tests := []struct {
+		name       string
+		certs      []*x509.Certificate
+		serverName string
+		records    []*dns.TLSA
+		want       bool
+	}{
+		{"EE", []*x509.Certificate{leaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(leaf, usageDANEEE, 1, 1)}, true},
+		{"EE ignores name", []*x509.Certificate{leaf}, "other.example.com", []*dns.TLSA{newTLSA(leaf, usageDANEEE, 0, 2)}, true},
+		{"EE ignores expiry", []*x509.Certificate{expiredLeaf}, "mx.example.com", []*dns.TLSA{newTLSA(expiredLeaf, usageDANEEE, 1, 1)}, true},
+		{"EE only matches leaf", []*x509.Certificate{leaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(ca, usageDANEEE, 1, 1)}, false},
+		{"TA", []*x509.Certificate{leaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(ca, usageDANETA, 0, 1)}, true},
+		{"TA fqdn", []*x509.Certificate{leaf, ca}, "mx.example.com.", []*dns.TLSA{newTLSA(ca, usageDANETA, 1, 2)}, true},
+		{"TA name mismatch", []*x509.Certificate{leaf, ca}, "other.example.com", []*dns.TLSA{newTLSA(ca, usageDANETA, 0, 1)}, false},
+		{"TA expired leaf", []*x509.Certificate{expiredLeaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(ca, usageDANETA, 0, 1)}, false},
+		{"TA not presented", []*x509.Certificate{leaf}, "mx.example.com", []*dns.TLSA{newTLSA(ca, usageDANETA, 0, 1)}, false},
+		{"TA other anchor", []*x509.Certificate{leaf, otherCA}, "mx.example.com", []*dns.TLSA{newTLSA(otherCA, usageDANETA, 0, 1)}, false},
+		{"second record", []*x509.Certificate{leaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(otherCA, usageDANEEE, 1, 1), newTLSA(leaf, usageDANEEE, 1, 1)}, true},
+		{"unsupported usage", []*x509.Certificate{leaf, ca}, "mx.example.com", []*dns.TLSA{newTLSA(leaf, 1, 1, 1)}, false},
+		{"no records", []*x509.Certificate{leaf, ca}, "mx.example.com", nil, false},
+		{"no certificates", nil, "mx.example.com", []*dns.TLSA{newTLSA(leaf, usageDANEEE, 1, 1)}, false},
+	}
+
+	for _, test := range tests {
+		err := Verify(tls.ConnectionState{PeerCertificates: test.certs}, test.serverName, test.records)
+		if got := err == nil; got != test.want {
+			t.Errorf("%v: Verify = %v, want success %v", test.name, err, test.want)
+		}
+	}
+}
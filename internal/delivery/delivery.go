@@ -0,0 +1,218 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/dane"
+	"github.com/coronon/pingpong-mail/internal/mtasts"
+	"github.com/coronon/pingpong-mail/internal/util"
+)
+
+// Fully built outgoing message together with its envelope
+type Message struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Data []byte `json:"data"`
+}
+
+// Reason a delivery failed and whether it makes sense to try again later
+type Error struct {
+	Temporary bool
+	// Outcome of the last attempt, nil if no attempt could be made
+	Result *Result
+	Err    error
+}
+
+func (e *Error) Error() string {
+	reason := fmt.Sprint(e.Err)
+	if e.Result != nil {
+		reason = e.Result.String()
+	}
+
+	if e.Temporary {
+		return fmt.Sprintf("temporary failure: %v", reason)
+	}
+	return fmt.Sprintf("permanent failure: %v", reason)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Check whether `err` is a delivery error worth retrying
+func IsTemporary(err error) bool {
+	var deliveryErr *Error
+	return errors.As(err, &deliveryErr) && deliveryErr.Temporary
+}
+
+// Deliver `msg` to the MX servers of its recipient domain
+//
+// MX servers and delivery ports are tried in order until a connection can be
+// established. Once connected, the result of that single SMTP exchange is final.
+//
+// If a relay is configured, all messages are sent through it instead.
+// The whole delivery is bounded by the configured delivery timeout and aborted
+// once `ctx` is cancelled.
+func Deliver(ctx context.Context, msg *Message) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Cnf.DeliveryTimeout)*time.Second)
+	defer cancel()
+
+	if config.Cnf.RelayHost != "" {
+		return deliverRelay(ctx, msg)
+	}
+
+	rcptDomain := util.GetDomainOrFallback(msg.To, "")
+	if rcptDomain == "" {
+		return &Error{Err: fmt.Errorf("could not determine domain for address: %v", msg.To)}
+	}
+	mxRecords, err := util.GetMXDomains(ctx, rcptDomain)
+	if err != nil {
+		res := newResult(rcptDomain, 0, &stageError{StageMX, err})
+		if errors.Is(err, config.ErrNullMX) {
+			// RFC 7505 section 4.1
+			res.Code, res.EnhancedCode = 556, "5.1.10"
+		} else if errors.Is(err, config.ErrNoMailHost) {
+			res.Code, res.EnhancedCode = 550, "5.1.2"
+		}
+		res.log(msg)
+
+		return &Error{Temporary: res.Temporary(), Result: res, Err: err}
+	}
+
+	opts := tlsPolicyOptions(tlsPolicyFor(rcptDomain))
+
+	//? Honour the MTA-STS policy of the recipient domain
+	if config.Cnf.EnableMTASTS {
+		policy, err := mtasts.Lookup(ctx, rcptDomain)
+		if err != nil {
+			zap.S().Infow("Could not retrieve MTA-STS policy", "domain", rcptDomain, "error", err)
+		}
+
+		mxRecords = applyMTASTS(policy, rcptDomain, mxRecords)
+		if len(mxRecords) == 0 {
+			return &Error{
+				Temporary: true,
+				Err:       fmt.Errorf("no MX host of %v matches its MTA-STS policy", rcptDomain),
+			}
+		}
+
+		if policy != nil && policy.Mode == mtasts.ModeEnforce {
+			opts = exchangeOptions{policy: policyMTASTS, requireTLS: true}
+		}
+	}
+
+	var lastResult *Result
+	for _, mx := range mxRecords {
+		for _, port := range config.Cnf.DeliveryPorts {
+			zap.S().Debugw("Trying to send email",
+				"from", msg.From,
+				"address", msg.To,
+				"domain", rcptDomain,
+				"mx_host", mx.Host,
+				"mx_pref", mx.Pref,
+				"port", port,
+			)
+
+			hostOpts := opts
+			if config.Cnf.EnableDANE {
+				hostOpts, err = applyDANE(ctx, opts, mx.Host, port)
+				if err != nil {
+					lastResult = newResult(mx.Host, port, &stageError{StageDial, err})
+					lastResult.setTLS(opts, nil)
+					lastResult.log(msg)
+					// A host whose TLSA records can't be retrieved must not be used
+					continue
+				}
+			}
+
+			res, err := attemptWithFallback(ctx, msg, mx.Host, port, hostOpts)
+			if err != nil {
+				//? Don't wait for a slot, the caller retries once the host is free
+				return &Error{Temporary: true, Err: err}
+			}
+			if res.Stage == StageDial {
+				lastResult = res
+				// Attempt other mx:port combination
+				continue
+			}
+			//? A host failing the required TLS authentication is treated like
+			//? an unreachable one, other MX servers may be configured correctly
+			if hostOpts.requireTLS && (res.Stage == StageTLS || res.Stage == StageSTARTTLS) {
+				lastResult = res
+				continue
+			}
+
+			//? Other MX servers are not tried once a connection was established,
+			//? the caller decides whether the outcome is worth another attempt
+			if !res.Delivered {
+				return &Error{Temporary: res.Temporary(), Result: res, Err: res.Err}
+			}
+
+			return nil
+		}
+	}
+
+	if lastResult == nil {
+		return &Error{Err: errors.New("no delivery ports configured")}
+	}
+
+	// No MX server was reachable or authenticated on any port
+	return &Error{Temporary: true, Result: lastResult, Err: lastResult.Err}
+}
+
+// Filter `mxRecords` down to the hosts permitted by `policy`
+//
+// Mismatches are only logged unless the policy is in enforce mode.
+func applyMTASTS(policy *mtasts.Policy, domain string, mxRecords []*net.MX) []*net.MX {
+	if policy == nil || policy.Mode == mtasts.ModeNone {
+		return mxRecords
+	}
+
+	permitted := make([]*net.MX, 0, len(mxRecords))
+	for _, mx := range mxRecords {
+		if policy.MatchMX(mx.Host) {
+			permitted = append(permitted, mx)
+			continue
+		}
+
+		zap.S().Infow("MX host does not match MTA-STS policy",
+			"domain", domain,
+			"mx_host", mx.Host,
+			"mode", policy.Mode,
+		)
+	}
+
+	if policy.Mode == mtasts.ModeEnforce {
+		return permitted
+	}
+	return mxRecords
+}
+
+// Require TLS authenticated by DANE if `host:port` has usable TLSA records
+//
+// DANE takes precedence over MTA-STS (RFC 8461 section 2).
+func applyDANE(ctx context.Context, opts exchangeOptions, host string, port int) (exchangeOptions, error) {
+	records, err := dane.Lookup(ctx, host, port)
+	if err != nil {
+		return opts, fmt.Errorf("TLSA lookup failed: %w", err)
+	}
+	if len(records) == 0 {
+		return opts, nil
+	}
+
+	zap.S().Debugw("Using DANE for delivery", "mx_host", host, "port", port, "records", len(records))
+
+	return exchangeOptions{
+		policy:     policyDANE,
+		requireTLS: true,
+		tlsConfig:  dane.TLSConfig(host, records),
+	}, nil
+}
@@ -0,0 +1,143 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/resolver"
+)
+
+// Connection extending its deadline by the command timeout before every read
+// and write, so a single stalled command can't block forever
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Open a TCP connection to `host:port` within the configured connect timeout
+//
+// The addresses of `host` are tried in the order given by the configured
+// address family, each from a matching configured source address (if any).
+func dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	ips, err := resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		localAddr, ok := sourceAddress(ip)
+		if !ok {
+			lastErr = fmt.Errorf("no source address configured for %v", ip)
+			continue
+		}
+
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(config.Cnf.ConnectTimeout) * time.Second,
+			LocalAddr: localAddr,
+		}
+
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			zap.S().Debugw("Could not dial address", "host", host, "address", addr, "error", err)
+			lastErr = err
+			continue
+		}
+
+		return conn, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no usable %v address for %v", config.Cnf.OutboundAddressFamily, host)
+	}
+	return nil, lastErr
+}
+
+// Resolve `host` to the addresses permitted by the configured address family
+func resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := resolver.Default.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	isIPv4 := func(ip net.IP) bool { return ip.To4() != nil }
+
+	switch config.Cnf.OutboundAddressFamily {
+	case config.AddressFamilyIPv4:
+		ips = slices.DeleteFunc(ips, func(ip net.IP) bool { return !isIPv4(ip) })
+	case config.AddressFamilyIPv6:
+		ips = slices.DeleteFunc(ips, isIPv4)
+	case config.AddressFamilyPreferIPv4:
+		slices.SortStableFunc(ips, func(a, b net.IP) int { return boolOrder(isIPv4(b), isIPv4(a)) })
+	case config.AddressFamilyPreferIPv6:
+		slices.SortStableFunc(ips, func(a, b net.IP) int { return boolOrder(isIPv4(a), isIPv4(b)) })
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.New("no address of the configured family")
+	}
+
+	return ips, nil
+}
+
+// Compare two booleans, ordering false before true
+func boolOrder(a bool, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// Pick a configured source address of the same family as `remote`
+//
+// Returns nil (system default) if no source addresses are configured at all
+// and false if none of them matches the family of `remote`.
+func sourceAddress(remote net.IP) (*net.TCPAddr, bool) {
+	if len(config.Cnf.OutboundSourceIPs) == 0 {
+		return nil, true
+	}
+
+	remoteIsIPv4 := remote.To4() != nil
+	for _, ip := range config.Cnf.OutboundSourceIPs {
+		if (ip.To4() != nil) == remoteIsIPv4 {
+			return &net.TCPAddr{IP: ip}, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,130 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Requirements for a single SMTP exchange
+type exchangeOptions struct {
+	// Name of the TLS policy these options implement, recorded with the result
+	policy string
+	// Fallback applied after the policy failed initially, if any
+	fallback string
+	// Fail unless the connection can be upgraded to verified TLS
+	requireTLS bool
+	// Config used for STARTTLS, WebPKI verification of the server name if nil
+	tlsConfig *tls.Config
+	// Don't attempt STARTTLS, e.g. when already connected over implicit TLS
+	disableTLS bool
+	// Perform a TLS handshake right after connecting (implicit TLS)
+	implicitTLS bool
+	// Authenticate using SMTP AUTH if set
+	auth smtp.Auth
+}
+
+// TLS config used for `serverName`, WebPKI verification if not overridden
+func (o exchangeOptions) tlsConfigFor(serverName string) *tls.Config {
+	if o.tlsConfig != nil {
+		return o.tlsConfig
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+	}
+}
+
+var errSTARTTLSUnavailable = errors.New("remote does not offer STARTTLS but TLS is required")
+
+// Perform the SMTP conversation necessary to send `msg` over `conn`
+//
+// This mirrors `mailyak.SmtpExchange`, but sends an already built message so it
+// can be persisted in between attempts. Errors are wrapped with the stage of
+// the conversation they occurred in.
+// `serverName` must be the hostname of the remote endpoint.
+// `conn` must already enforce the command timeout (see `deadlineConn`), it is
+// closed as soon as `ctx` is done.
+//
+// Returns the state of the TLS connection if STARTTLS was used.
+func exchange(
+	ctx context.Context,
+	msg *Message,
+	conn net.Conn,
+	serverName string,
+	opts exchangeOptions,
+) (*tls.ConnectionState, error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	tlsState, err := converse(msg, conn, serverName, opts)
+
+	// Surface why the connection was closed underneath the conversation
+	var stageErr *stageError
+	if ctx.Err() != nil && errors.As(err, &stageErr) {
+		stageErr.err = fmt.Errorf("%w: %w", ctx.Err(), stageErr.err)
+	}
+
+	return tlsState, err
+}
+
+// SMTP conversation of `exchange`
+func converse(msg *Message, conn net.Conn, serverName string, opts exchangeOptions) (*tls.ConnectionState, error) {
+	var tlsState *tls.ConnectionState
+
+	// The greeting is read when creating the client
+	c, err := smtp.NewClient(conn, serverName)
+	if err != nil {
+		return nil, &stageError{StageEHLO, err}
+	}
+	defer func() { _ = c.Quit() }()
+
+	if err := c.Hello(config.Cnf.OutboundHeloName); err != nil {
+		return nil, &stageError{StageEHLO, err}
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !opts.disableTLS {
+		if err := c.StartTLS(opts.tlsConfigFor(serverName)); err != nil {
+			return nil, &stageError{StageSTARTTLS, err}
+		}
+		if state, ok := c.TLSConnectionState(); ok {
+			tlsState = &state
+		}
+	} else if opts.requireTLS {
+		return nil, &stageError{StageSTARTTLS, errSTARTTLSUnavailable}
+	}
+
+	if opts.auth != nil {
+		if err := c.Auth(opts.auth); err != nil {
+			return tlsState, &stageError{StageAUTH, err}
+		}
+	}
+
+	if err := c.Mail(msg.From); err != nil {
+		return tlsState, &stageError{StageMAIL, err}
+	}
+
+	if err := c.Rcpt(msg.To); err != nil {
+		return tlsState, &stageError{StageRCPT, err}
+	}
+
+	dataSession, err := c.Data()
+	if err != nil {
+		return tlsState, &stageError{StageDATA, err}
+	}
+
+	if _, err := dataSession.Write(msg.Data); err != nil {
+		return tlsState, &stageError{StageDATA, err}
+	}
+
+	if err := dataSession.Close(); err != nil {
+		return tlsState, &stageError{StageDATA, err}
+	}
+
+	return tlsState, nil
+}
@@ -0,0 +1,109 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Matches every `HostBusyError`
+var ErrHostBusy = errors.New("all connection slots to the remote host are in use")
+
+// Returned instead of attempting a delivery while all connection slots to
+// `Host` are in use
+//
+// Callers should wait for a free slot using `WaitHost` before trying again.
+type HostBusyError struct {
+	Host string
+}
+
+func (e *HostBusyError) Error() string {
+	return "all connection slots to " + e.Host + " are in use"
+}
+
+func (e *HostBusyError) Is(target error) bool {
+	return target == ErrHostBusy
+}
+
+// Connection slots of a single remote host
+type hostSlots struct {
+	slots chan struct{}
+	// Closed and replaced whenever a slot is released
+	freed chan struct{}
+}
+
+var (
+	hostsMu sync.Mutex
+	hosts   = make(map[string]*hostSlots)
+)
+
+// Normalized key of `host` in `hosts`
+func hostKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Take a free connection slot to `host`
+//
+// At most `delivery_workers_per_mx` connections to the same host are open at
+// any time. Never waits, returns a `HostBusyError` if all slots are in use so
+// the worker can deliver to other hosts meanwhile.
+// The returned function must be called to release the slot.
+func acquireHost(host string) (func(), error) {
+	key := hostKey(host)
+
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+
+	h, ok := hosts[key]
+	if !ok {
+		h = &hostSlots{
+			slots: make(chan struct{}, config.Cnf.DeliveryWorkersPerMX),
+			freed: make(chan struct{}),
+		}
+		hosts[key] = h
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		return nil, &HostBusyError{Host: key}
+	}
+
+	return func() {
+		hostsMu.Lock()
+		defer hostsMu.Unlock()
+
+		<-h.slots
+		close(h.freed)
+		h.freed = make(chan struct{})
+
+		//? Forget hosts nobody is connected to, the map would grow forever otherwise
+		if len(h.slots) == 0 {
+			delete(hosts, key)
+		}
+	}, nil
+}
+
+// Wait until a connection slot to `host` is free or `ctx` is done
+//
+// The slot is not reserved, another delivery may still take it first.
+func WaitHost(ctx context.Context, host string) error {
+	hostsMu.Lock()
+	h, ok := hosts[hostKey(host)]
+	if !ok || len(h.slots) < cap(h.slots) {
+		hostsMu.Unlock()
+		return nil
+	}
+	freed := h.freed
+	hostsMu.Unlock()
+
+	select {
+	case <-freed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
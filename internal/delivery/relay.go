@@ -0,0 +1,97 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Deliver `msg` through the configured smart-host instead of the recipients MX
+func deliverRelay(ctx context.Context, msg *Message) error {
+	host := config.Cnf.RelayHostname
+	port := config.Cnf.RelayPort
+
+	zap.S().Debugw("Trying to send email via relay",
+		"from", msg.From,
+		"address", msg.To,
+		"relay_host", host,
+		"port", port,
+	)
+
+	opts := exchangeOptions{
+		policy:      policyRelay,
+		auth:        relayAuth(host),
+		requireTLS:  config.Cnf.RelayTLS == config.RelayTLSStartTLS,
+		disableTLS:  config.Cnf.RelayTLS != config.RelayTLSStartTLS,
+		implicitTLS: config.Cnf.RelayTLS == config.RelayTLSImplicit,
+	}
+
+	release, err := acquireHost(host)
+	if err != nil {
+		return &Error{Temporary: true, Err: err}
+	}
+	defer release()
+
+	res := attempt(ctx, msg, host, port, opts)
+	if !res.Delivered {
+		return &Error{Temporary: res.Temporary(), Result: res, Err: res.Err}
+	}
+
+	return nil
+}
+
+// Build the SMTP AUTH mechanism configured for the relay, nil if disabled
+func relayAuth(host string) smtp.Auth {
+	username := config.Cnf.RelayUsername
+	password := config.Cnf.RelayPassword
+
+	switch config.Cnf.RelayAuth {
+	case config.RelayAuthPlain:
+		return smtp.PlainAuth("", username, password, host)
+	case config.RelayAuthLogin:
+		return &loginAuth{username: username, password: password, host: host}
+	case config.RelayAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(username, password)
+	default:
+		return nil
+	}
+}
+
+// LOGIN mechanism, which `net/smtp` does not implement
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same restrictions as `smtp.PlainAuth`, credentials are sent in plain text
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, errors.New("unexpected LOGIN challenge")
+	}
+}
@@ -0,0 +1,196 @@
+package delivery
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Stage of the outbound SMTP conversation
+type Stage string
+
+const (
+	StageMX       Stage = "mx"
+	StageDial     Stage = "dial"
+	StageTLS      Stage = "tls"
+	StageEHLO     Stage = "ehlo"
+	StageSTARTTLS Stage = "starttls"
+	StageAUTH     Stage = "auth"
+	StageMAIL     Stage = "mail"
+	StageRCPT     Stage = "rcpt"
+	StageDATA     Stage = "data"
+)
+
+// RFC 3463 enhanced status code at the start of a reply text, e.g. "4.7.1"
+var enhancedCodeRegex = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s*`)
+
+// Structured outcome of a single delivery attempt
+type Result struct {
+	MXHost string
+	Port   int
+
+	// Whether the remote accepted the message
+	Delivered bool
+	// Stage that failed, empty if delivered
+	Stage Stage
+	// SMTP reply code, 0 if the remote never replied (e.g. dial failures)
+	//
+	// Permanent DNS outcomes carry the equivalent code a remote would have
+	// used, e.g. 556 for a null MX.
+	Code int
+	// RFC 3463 enhanced status code, if the remote sent one
+	EnhancedCode string
+	// Remote reply text (or local error) without the status codes
+	Text string
+
+	// Outbound TLS policy applied to the attempt
+	TLSPolicy string
+	// Fallback of the policy applied after the initial attempt failed, if any
+	TLSFallback string
+	// Negotiated TLS version and cipher suite, empty if not encrypted
+	TLSVersion string
+	TLSCipher  string
+	// Whether the certificate of the remote was verified (WebPKI or DANE)
+	TLSVerified bool
+
+	Err error
+}
+
+// Error raised during `stage` of the SMTP conversation
+type stageError struct {
+	stage Stage
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%v: %v", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// Build the result of an attempt against `mxHost:port` that ended with `err`
+func newResult(mxHost string, port int, err error) *Result {
+	res := &Result{
+		MXHost:    mxHost,
+		Port:      port,
+		Delivered: err == nil,
+		Err:       err,
+	}
+	if err == nil {
+		return res
+	}
+
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		res.Stage = stageErr.stage
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		res.Code = protoErr.Code
+		res.Text = strings.ReplaceAll(protoErr.Msg, "\n", " ")
+
+		if match := enhancedCodeRegex.FindStringSubmatch(res.Text); match != nil {
+			res.EnhancedCode = match[1]
+			res.Text = res.Text[len(match[0]):]
+		}
+	} else if stageErr != nil {
+		res.Text = stageErr.err.Error()
+	} else {
+		res.Text = err.Error()
+	}
+
+	return res
+}
+
+// Record the TLS policy of `opts` and the negotiated TLS `state` (if any)
+func (r *Result) setTLS(opts exchangeOptions, state *tls.ConnectionState) {
+	r.TLSPolicy = opts.policy
+	r.TLSFallback = opts.fallback
+
+	if state == nil {
+		return
+	}
+
+	tlsConfig := opts.tlsConfigFor(r.MXHost)
+	r.TLSVersion = tls.VersionName(state.Version)
+	r.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	r.TLSVerified = !tlsConfig.InsecureSkipVerify || tlsConfig.VerifyConnection != nil
+}
+
+// Whether the attempt failed in a way worth retrying later
+//
+// 4xx replies, broken connections and failures to establish TLS (handshake,
+// certificate or missing STARTTLS) are temporary, the remote may be fixed or
+// another MX host may be tried (RFC 7672 section 2.2, RFC 8461 section 5).
+// Everything else (5xx replies, ...) is permanent.
+func (r *Result) Temporary() bool {
+	if r.Delivered {
+		return false
+	}
+
+	if r.Code != 0 {
+		return r.Code >= 400 && r.Code < 500
+	}
+
+	var netErr net.Error
+	return r.Stage == StageDial ||
+		r.Stage == StageTLS ||
+		r.Stage == StageSTARTTLS ||
+		errors.As(r.Err, &netErr) ||
+		errors.Is(r.Err, io.EOF) ||
+		errors.Is(r.Err, io.ErrUnexpectedEOF)
+}
+
+// Short human readable description, e.g. "rcpt 450 4.2.0 greylisted"
+func (r *Result) String() string {
+	if r.Delivered {
+		return fmt.Sprintf("delivered to %v:%v", r.MXHost, r.Port)
+	}
+
+	parts := []string{string(r.Stage)}
+	if r.Code != 0 {
+		parts = append(parts, fmt.Sprint(r.Code))
+	}
+	if r.EnhancedCode != "" {
+		parts = append(parts, r.EnhancedCode)
+	}
+	parts = append(parts, r.Text)
+
+	if r.Port == 0 {
+		return fmt.Sprintf("%v (%v)", strings.Join(parts, " "), r.MXHost)
+	}
+	return fmt.Sprintf("%v (%v:%v)", strings.Join(parts, " "), r.MXHost, r.Port)
+}
+
+// Log the outcome of a delivery attempt for `msg`
+//
+// Outcomes are logged at info level so operators can see why a reply never
+// arrived without enabling verbose output.
+func (r *Result) log(msg *Message) {
+	zap.S().Infow("Delivery attempt",
+		"id", msg.ID,
+		"to", msg.To,
+		"mx_host", r.MXHost,
+		"port", r.Port,
+		"delivered", r.Delivered,
+		"stage", r.Stage,
+		"code", r.Code,
+		"enhanced_code", r.EnhancedCode,
+		"text", r.Text,
+		"tls_policy", r.TLSPolicy,
+		"tls_fallback", r.TLSFallback,
+		"tls_version", r.TLSVersion,
+		"tls_cipher", r.TLSCipher,
+		"tls_verified", r.TLSVerified,
+	)
+}
@@ -0,0 +1,63 @@
+package delivery
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestNewResult(t *testing.T) {
+	err := &stageError{StageRCPT, &textproto.Error{Code: 550, Msg: "5.1.1 user unknown\nin this domain"}}
+	res := newResult("mx.example.com", 25, err)
+
+	if res.Delivered || res.Stage != StageRCPT {
+		t.Errorf("delivered = %v, stage = %q, want failed rcpt", res.Delivered, res.Stage)
+	}
+	if res.Code != 550 || res.EnhancedCode != "5.1.1" || res.Text != "user unknown in this domain" {
+		t.Errorf("code = %v, enhanced = %q, text = %q", res.Code, res.EnhancedCode, res.Text)
+	}
+	if want := "rcpt 550 5.1.1 user unknown in this domain (mx.example.com:25)"; res.String() != want {
+		t.Errorf("String() = %q, want %q", res.String(), want)
+	}
+
+	res = newResult("mx.example.com", 25, nil)
+	if !res.Delivered || res.Temporary() {
+		t.Errorf("nil error: delivered = %v, temporary = %v", res.Delivered, res.Temporary())
+	}
+
+	res = newResult("mx.example.com", 25, &stageError{StageDial, errors.New("connection refused")})
+	if res.Code != 0 || res.Text != "connection refused" {
+		t.Errorf("dial: code = %v, text = %q", res.Code, res.Text)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	certErr := &x509.HostnameError{Certificate: &x509.Certificate{}, Host: "mx.example.com"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"4xx reply", &stageError{StageRCPT, &textproto.Error{Code: 450, Msg: "4.2.0 greylisted"}}, true},
+		{"5xx reply", &stageError{StageRCPT, &textproto.Error{Code: 550, Msg: "5.1.1 unknown"}}, false},
+		{"5xx STARTTLS reply", &stageError{StageSTARTTLS, &textproto.Error{Code: 554, Msg: "no"}}, false},
+		{"dial failure", &stageError{StageDial, errors.New("no route to host")}, true},
+		{"implicit TLS certificate", &stageError{StageTLS, certErr}, true},
+		{"STARTTLS certificate", &stageError{StageSTARTTLS, certErr}, true},
+		{"STARTTLS unavailable", &stageError{StageSTARTTLS, errSTARTTLSUnavailable}, true},
+		{"connection closed", &stageError{StageDATA, io.EOF}, true},
+		{"network error", &stageError{StageMAIL, &net.OpError{Op: "read", Err: errors.New("reset")}}, true},
+		{"local error", &stageError{StageAUTH, errors.New("unencrypted connection")}, false},
+	}
+
+	for _, test := range tests {
+		res := newResult("mx.example.com", 25, test.err)
+		if got := res.Temporary(); got != test.want {
+			t.Errorf("%v: Temporary() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Policies applied instead of the configured one
+const (
+	policyMTASTS = "mta-sts"
+	policyDANE   = "dane"
+	policyRelay  = "relay"
+)
+
+// Fallbacks applied when the initial TLS policy failed
+const (
+	fallbackUnverified = "unverified"
+	fallbackPlaintext  = "plaintext"
+)
+
+// Outbound TLS policy configured for `domain`
+func tlsPolicyFor(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if policy, ok := config.Cnf.OutboundTLSPolicyDomains[domain]; ok {
+		return policy
+	}
+
+	return config.Cnf.OutboundTLSPolicy
+}
+
+// Exchange options implementing the outbound TLS `policy`
+func tlsPolicyOptions(policy string) exchangeOptions {
+	opts := exchangeOptions{policy: policy}
+
+	switch policy {
+	case config.TLSPolicyNone:
+		opts.disableTLS = true
+	case config.TLSPolicyRequire:
+		opts.requireTLS = true
+	}
+
+	return opts
+}
+
+// Options for retrying an attempt that failed during STARTTLS, if the policy
+// allows a fallback
+//
+// `opportunistic` retries without certificate verification if the handshake
+// failed, `opportunistic-plaintext` retries without STARTTLS altogether.
+func tlsFallback(res *Result, opts exchangeOptions, serverName string) (exchangeOptions, bool) {
+	if res.Delivered || res.Stage != StageSTARTTLS || opts.fallback != "" {
+		return opts, false
+	}
+
+	switch opts.policy {
+	case config.TLSPolicyOpportunistic:
+		// The remote refused STARTTLS itself, verification is not the problem
+		if res.Code != 0 {
+			return opts, false
+		}
+		opts.fallback = fallbackUnverified
+		opts.tlsConfig = &tls.Config{
+			ServerName: serverName,
+			//nolint:gosec // Explicitly requested by the policy
+			InsecureSkipVerify: true,
+		}
+	case config.TLSPolicyOpportunisticPlaintext:
+		opts.fallback = fallbackPlaintext
+		opts.disableTLS = true
+	default:
+		return opts, false
+	}
+
+	return opts, true
+}
+
+// Attempt a delivery of `msg` to `host:port`, applying TLS fallbacks of the
+// policy in `opts` if required
+//
+// Returns a `HostBusyError` without attempting anything if all connection slots to
+// `host` are in use.
+func attemptWithFallback(ctx context.Context, msg *Message, host string, port int, opts exchangeOptions) (*Result, error) {
+	release, err := acquireHost(host)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	res := attempt(ctx, msg, host, port, opts)
+
+	if fallbackOpts, ok := tlsFallback(res, opts, host); ok {
+		zap.S().Infow("Retrying delivery with TLS fallback",
+			"id", msg.ID,
+			"mx_host", host,
+			"port", port,
+			"tls_policy", opts.policy,
+			"fallback", fallbackOpts.fallback,
+		)
+
+		res = attempt(ctx, msg, host, port, fallbackOpts)
+	}
+
+	return res, nil
+}
+
+// Attempt a single delivery of `msg` to `host:port`
+//
+// The caller must hold a connection slot to `host` (see `acquireHost`).
+func attempt(ctx context.Context, msg *Message, host string, port int, opts exchangeOptions) *Result {
+	conn, err := dial(ctx, host, port)
+	if err != nil {
+		res := newResult(host, port, &stageError{StageDial, err})
+		res.setTLS(opts, nil)
+		res.log(msg)
+		return res
+	}
+
+	//? Wrap the raw connection, `net/smtp` only treats it as encrypted if it is
+	//? passed a `*tls.Conn`
+	conn = &deadlineConn{
+		Conn:    conn,
+		timeout: time.Duration(config.Cnf.CommandTimeout) * time.Second,
+	}
+	defer func() { _ = conn.Close() }()
+
+	var implicitState *tls.ConnectionState
+	if opts.implicitTLS {
+		tlsConn := tls.Client(conn, opts.tlsConfigFor(host))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			res := newResult(host, port, &stageError{StageTLS, err})
+			res.setTLS(opts, nil)
+			res.log(msg)
+			return res
+		}
+		state := tlsConn.ConnectionState()
+		implicitState = &state
+		conn = tlsConn
+	}
+
+	tlsState, err := exchange(ctx, msg, conn, host, opts)
+	if implicitState != nil {
+		tlsState = implicitState
+	}
+
+	res := newResult(host, port, err)
+	res.setTLS(opts, tlsState)
+	res.log(msg)
+
+	return res
+}
@@ -0,0 +1,134 @@
+package dkimsign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// Header fields signed if neither the key nor `dkim_headers` specify any
+var defaultHeaders = []string{
+	"From",
+	"Reply-To",
+	"Sender",
+	"To",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Auto-Submitted",
+}
+
+// Signing options by (lowercase) domain
+var signers = make(map[string]*dkim.SignOptions)
+
+// Load all configured DKIM signing keys
+//
+// Must be called AFTER the configuration was initialized.
+func LoadKeys() {
+	for _, key := range config.Cnf.DKIMKeys {
+		signer, err := readPrivateKey(key.PrivateKeyPath)
+		if err != nil {
+			zap.S().Fatalw("Could not load DKIM private key",
+				"domain", key.Domain,
+				"selector", key.Selector,
+				"private_key_path", key.PrivateKeyPath,
+				"error", err,
+			)
+		}
+
+		headers := key.Headers
+		if len(headers) == 0 {
+			headers = config.Cnf.DKIMHeaders
+		}
+		if len(headers) == 0 {
+			headers = defaultHeaders
+		}
+
+		opts := &dkim.SignOptions{
+			Domain:                 key.Domain,
+			Selector:               key.Selector,
+			Signer:                 signer,
+			HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+			BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+			HeaderKeys:             headers,
+		}
+
+		// Validate options early instead of failing for every reply
+		if _, err := dkim.NewSigner(opts); err != nil {
+			zap.S().Fatalw("Invalid DKIM signing configuration",
+				"domain", key.Domain,
+				"selector", key.Selector,
+				"error", err,
+			)
+		}
+
+		signers[strings.ToLower(key.Domain)] = opts
+
+		zap.S().Debugw("Loaded DKIM signing key",
+			"domain", key.Domain,
+			"selector", key.Selector,
+			"headers", headers,
+		)
+	}
+}
+
+// Sign the message `data` with the key configured for `fromDomain`
+//
+// The DKIM-Signature header is prepended to `data`. If no key is configured for
+// the domain, `data` is returned unaltered.
+func Sign(data []byte, fromDomain string) ([]byte, error) {
+	opts, ok := signers[strings.ToLower(fromDomain)]
+	if !ok {
+		zap.S().Debugw("No DKIM key configured", "domain", fromDomain)
+		return data, nil
+	}
+
+	signed := new(bytes.Buffer)
+	if err := dkim.Sign(signed, bytes.NewReader(data), opts); err != nil {
+		return nil, err
+	}
+
+	return signed.Bytes(), nil
+}
+
+// Read a PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return signer, nil
+}
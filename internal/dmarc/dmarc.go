@@ -2,13 +2,17 @@ package dmarc
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/chrj/smtpd"
 	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/resolver"
 	"github.com/coronon/pingpong-mail/internal/util"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-msgauth/dmarc"
@@ -16,92 +20,163 @@ import (
 	"golang.org/x/net/publicsuffix"
 )
 
+// Outcome of the DMARC evaluation of an incoming email
+//
+// Filled as far as the evaluation got, even if it failed.
+type Result struct {
+	// Result of the SPF check, e.g. `pass`, `fail` or `softfail`
+	SPF string
+	// Domain SPF was evaluated for
+	SPFDomain string
+	// Whether SPF passed and is aligned with the <From:> domain
+	SPFAligned bool
+	// `pass` if at least one DKIM signature is valid, `fail` if none of them
+	// is and `none` if the email is not signed
+	DKIM string
+	// Domains of all valid DKIM signatures
+	DKIMDomains []string
+	// Whether a valid DKIM signature is aligned with the <From:> domain
+	DKIMAligned bool
+	// All DKIM signatures of the email
+	DKIMSignatures []*Signature
+	// Domain the DMARC record was found at, the <From:> domain or its
+	// organizational domain
+	Domain string
+	// DMARC record as published, empty if none was found
+	Record string
+	// Policy published by the domain, e.g. `none`, `quarantine` or `reject`
+	Policy string
+	// Alignment modes required for SPF and DKIM, `relaxed` or `strict`
+	SPFAlignment  string
+	DKIMAlignment string
+	// Overall outcome, `pass` or `fail`
+	DMARC string
+}
+
 // Fully validate DMARC compliance including alignment
 func CheckDmarc(
 	peer *smtpd.Peer,
 	env *smtpd.Envelope,
 	fromHeaderDomain string,
-	senderDomain string,
-) error {
+) (*Result, error) {
+	//? DMARC applies to the <From:> domain (RFC 7489 section 3.1), which may
+	//? differ from the envelope sender, e.g. with bulk mail providers
+	res := &Result{DMARC: "fail", Domain: fromHeaderDomain}
+
 	// Check DMARC framework
-	dmarcRecord, err := dmarc.Lookup(senderDomain)
+	record, recordDomain, err := lookupRecord(fromHeaderDomain)
+	if err != nil {
+		zap.S().Debugw("DMARC lookup failed", "domain", fromHeaderDomain, "error", err)
+		return res, config.ErrDMARCFailed
+	}
+	res.Domain = recordDomain
+	dmarcRecord, err := dmarc.Parse(record)
 	if err != nil {
-		zap.S().Debugw("DMARC lookup failed", "error", err)
-		return config.ErrDMARCFailed
+		zap.S().Debugw("DMARC record invalid", "domain", recordDomain, "error", err)
+		return res, config.ErrDMARCFailed
 	}
+	res.Record = record
+	res.Policy = string(dmarcRecord.Policy)
+	//? The subdomain policy applies to subdomains of the organizational domain
+	if recordDomain != fromHeaderDomain && dmarcRecord.SubdomainPolicy != "" {
+		res.Policy = string(dmarcRecord.SubdomainPolicy)
+	}
+	res.SPFAlignment = alignmentName(dmarcRecord.SPFAlignment)
+	res.DKIMAlignment = alignmentName(dmarcRecord.DKIMAlignment)
 
-	validSPFDomain, err := getValidSPF(peer, env)
+	spfResult, validSPFDomain, err := getValidSPF(peer, env)
+	res.SPF = string(spfResult)
+	res.SPFDomain = util.GetDomainOrFallback(env.Sender, peer.HeloName)
 	if err != nil {
 		zap.S().Debugw("SPF validation failed", "error", err)
-		return err
+		return res, err
 	}
 	isSPFValid := checkAlignment(fromHeaderDomain, validSPFDomain, dmarcRecord.SPFAlignment)
+	res.SPFAligned = isSPFValid
 
-	validDKIMDomains, err := getValidDKIM(peer, env)
+	validDKIMDomains, verifications, err := getValidDKIM(peer, env)
 	if err != nil {
 		zap.S().Debugw("DKIM validation failed", "error", err)
-		return err
+		return res, err
+	}
+	res.DKIMDomains = validDKIMDomains
+	res.DKIMSignatures = buildSignatures(env.Data, verifications)
+	switch {
+	case len(validDKIMDomains) > 0:
+		res.DKIM = "pass"
+	case len(verifications) > 0:
+		res.DKIM = "fail"
+	default:
+		res.DKIM = "none"
 	}
 	isDKIMValid := false
-	for i := range validDKIMDomains {
-		if checkAlignment(fromHeaderDomain, validDKIMDomains[i], dmarcRecord.DKIMAlignment) {
-			isDKIMValid = true
-			break
-		}
+	for _, sig := range res.DKIMSignatures {
+		sig.Aligned = sig.Result == "pass" &&
+			checkAlignment(fromHeaderDomain, sig.Domain, dmarcRecord.DKIMAlignment)
+		isDKIMValid = isDKIMValid || sig.Aligned
 	}
+	res.DKIMAligned = isDKIMValid
 
 	zap.S().Debugf("SPF valid: %v, DKIM valid: %v -> %v\n", isSPFValid, isDKIMValid, isSPFValid || isDKIMValid)
 
 	if !isSPFValid && !isDKIMValid {
 		zap.S().Debug("DMARC validation failed")
-		return config.ErrDMARCFailed
+		return res, config.ErrDMARCFailed
 	}
 
 	// All checks passed -> no error
 	zap.S().Debug("DMARC passed")
-	return nil
+	res.DMARC = "pass"
+	return res, nil
 }
 
 // Get domain with valid SPF record
-func getValidSPF(peer *smtpd.Peer, env *smtpd.Envelope) (string, error) {
+func getValidSPF(peer *smtpd.Peer, env *smtpd.Envelope) (spf.Result, string, error) {
 	// Get senders ip address
 	tcpAddr, ok := peer.Addr.(*net.TCPAddr)
 	if !ok {
-		return "", fmt.Errorf("invalid sender address: %v", peer.Addr)
+		return spf.None, "", fmt.Errorf("invalid sender address: %v", peer.Addr)
 	}
 
 	// Check if `sender` is authorized to send from the given `ip`.
 	// The `domain` is used if the sender doesn't have one.
-	spfResult, err := spf.CheckHostWithSender(tcpAddr.IP, peer.HeloName, env.Sender)
+	spfResult, err := spf.CheckHostWithSender(
+		tcpAddr.IP,
+		peer.HeloName,
+		env.Sender,
+		spf.WithResolver(resolver.Default),
+	)
 	if err != nil && (spfResult == spf.PermError || spfResult == spf.TempError) {
 		// This is not returned if SPF failes, but if it can't even be validated
-		return "", config.ErrSPFCantValidate
+		return spfResult, "", config.ErrSPFCantValidate
 	}
 
 	//? Match return the domain that was validated
 	// This is a little ugly but streamlines the flow in `handler`
 	if spfResult == spf.Pass {
-		return util.GetDomainOrFallback(env.Sender, peer.HeloName), nil
+		return spfResult, util.GetDomainOrFallback(env.Sender, peer.HeloName), nil
 	}
 
-	return "", nil
+	return spfResult, "", nil
 }
 
-// Get domains with a valid DKIM signature
-func getValidDKIM(peer *smtpd.Peer, env *smtpd.Envelope) ([]string, error) {
+// Get domains with a valid DKIM signature and all verifications
+func getValidDKIM(peer *smtpd.Peer, env *smtpd.Envelope) ([]string, []*dkim.Verification, error) {
 	validSignatures := make([]string, 0)
 
 	reader := bytes.NewReader(env.Data)
 
-	verifications, err := dkim.Verify(reader)
+	verifications, err := dkim.VerifyWithOptions(reader, &dkim.VerifyOptions{
+		LookupTXT: resolver.Default.LookupTXTFunc(),
+	})
 	if err != nil {
 		// This is not returned if DKIM failes, but if it can't even be validated
-		return validSignatures, config.ErrDKIMCantValidate
+		return validSignatures, nil, config.ErrDKIMCantValidate
 	}
 
 	// No signatures -> failed
 	if len(verifications) == 0 {
-		return validSignatures, nil
+		return validSignatures, nil, nil
 	}
 
 	for _, v := range verifications {
@@ -110,7 +185,69 @@ func getValidDKIM(peer *smtpd.Peer, env *smtpd.Envelope) ([]string, error) {
 		}
 	}
 
-	return validSignatures, nil
+	return validSignatures, verifications, nil
+}
+
+// Raw DMARC record applying to `domain` and the domain it was found at
+//
+// Falls back to the record of the organizational domain if `domain` publishes
+// none. Fails unless exactly one record is published (RFC 7489 section 6.6.3).
+func lookupRecord(domain string) (string, string, error) {
+	timeout := time.Duration(config.Cnf.DNSTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	records, err := lookupRecords(ctx, domain)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(records) == 0 {
+		orgDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(domain, "."))
+		if err == nil && !strings.EqualFold(orgDomain, strings.TrimSuffix(domain, ".")) {
+			domain = orgDomain
+			records, err = lookupRecords(ctx, domain)
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	if len(records) != 1 {
+		return "", "", fmt.Errorf("found %v DMARC records", len(records))
+	}
+
+	return records[0], domain, nil
+}
+
+// All DMARC records published at `domain`, none if the name does not exist
+func lookupRecords(ctx context.Context, domain string) ([]string, error) {
+	txts, err := resolver.Default.LookupTXT(ctx, "_dmarc."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	return records, nil
+}
+
+// Human readable name of an alignment mode, relaxed if not specified
+func alignmentName(mode dmarc.AlignmentMode) string {
+	if mode == dmarc.AlignmentStrict {
+		return "strict"
+	}
+
+	return "relaxed"
 }
 
 // Validate alignment between the <FROM:> header and a validated SPF/DKIM domain
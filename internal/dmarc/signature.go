@@ -0,0 +1,159 @@
+package dmarc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/resolver"
+)
+
+// DKIM signature of an incoming email and the outcome of its verification
+type Signature struct {
+	// Signing domain (`d=`)
+	Domain string
+	// Selector of the public key (`s=`)
+	Selector string
+	// Signing algorithm (`a=`), e.g. `rsa-sha256`
+	Algorithm string
+	// `pass`, `fail`, `permerror` or `temperror`
+	Result string
+	// Reason the verification did not pass
+	Error string
+	// Whether the signing domain is aligned with the <From:> domain
+	Aligned bool
+
+	keySizeOnce sync.Once
+	keySize     int
+}
+
+// Size of the public key in bits, 0 if the key could not be retrieved
+//
+// Only looked up if a template uses it.
+func (s *Signature) KeySize() int {
+	s.keySizeOnce.Do(func() {
+		if s.Domain == "" || s.Selector == "" {
+			return
+		}
+
+		timeout := time.Duration(config.Cnf.DNSTimeout) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		s.keySize = lookupKeySize(ctx, s.Domain, s.Selector)
+	})
+
+	return s.keySize
+}
+
+// Build the signatures of `data` from their DKIM verifications
+//
+// go-msgauth reports verifications in the order of the DKIM-Signature header
+// fields, but not the selector or algorithm, so those are parsed separately.
+func buildSignatures(data []byte, verifications []*dkim.Verification) []*Signature {
+	var fields []string
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		fields = msg.Header["Dkim-Signature"]
+	}
+
+	signatures := make([]*Signature, 0, len(verifications))
+	for i, v := range verifications {
+		sig := &Signature{Domain: v.Domain, Result: "pass"}
+
+		if i < len(fields) {
+			tags := parseTags(fields[i])
+			sig.Selector = tags["s"]
+			sig.Algorithm = tags["a"]
+			if sig.Domain == "" {
+				sig.Domain = tags["d"]
+			}
+		}
+
+		if v.Err != nil {
+			sig.Error = v.Err.Error()
+			switch {
+			case dkim.IsTempFail(v.Err):
+				sig.Result = "temperror"
+			case dkim.IsPermFail(v.Err):
+				sig.Result = "permerror"
+			default:
+				sig.Result = "fail"
+			}
+		}
+
+		signatures = append(signatures, sig)
+	}
+
+	return signatures
+}
+
+// Size in bits of the DKIM public key published by `domain` for `selector`
+//
+// Returns 0 if the key can't be retrieved or parsed.
+func lookupKeySize(ctx context.Context, domain string, selector string) int {
+	records, err := resolver.Default.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return 0
+	}
+
+	for _, record := range records {
+		tags := parseTags(record)
+		if tags["p"] == "" {
+			continue
+		}
+
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["p"]), ""))
+		if err != nil {
+			continue
+		}
+
+		if strings.EqualFold(tags["k"], "ed25519") {
+			return len(der) * 8
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some publish bare PKCS #1 keys
+			if rsaPub, err := x509.ParsePKCS1PublicKey(der); err == nil {
+				return rsaPub.N.BitLen()
+			}
+			continue
+		}
+
+		switch key := pub.(type) {
+		case *rsa.PublicKey:
+			return key.N.BitLen()
+		case ed25519.PublicKey:
+			return len(key) * 8
+		}
+	}
+
+	return 0
+}
+
+// Parse a DKIM tag list (`k=v; k2=v2`) as used by signatures and key records
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, pair := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+
+		//? Values may be folded across lines, whitespace carries no meaning
+		tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(val), "")
+	}
+
+	return tags
+}
@@ -0,0 +1,297 @@
+package mtasts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/resolver"
+)
+
+// Policy modes as defined in RFC 8461 section 5
+type Mode string
+
+const (
+	ModeEnforce Mode = "enforce"
+	ModeTesting Mode = "testing"
+	ModeNone    Mode = "none"
+)
+
+// Policies are not cached for longer than one year (RFC 8461 section 3.2)
+const maxPolicyAge = 31557600 * time.Second
+
+// Policy files larger than this are rejected (RFC 8461 section 3.3)
+const maxPolicySize = 64 * 1024
+
+// Client used to fetch policy files
+//
+// Can be replaced, e.g. to fetch policies from a local HTTPS server in tests.
+// Redirects must not be followed (RFC 8461 section 3.3).
+var HTTPClient = &http.Client{
+	Timeout: 60 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext:         dialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// Dial `addr`, resolving its host using the application resolver
+func dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := resolver.Default.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// MTA-STS policy of a single domain
+type Policy struct {
+	// Identifier of the `_mta-sts` TXT record the policy was fetched for
+	ID      string
+	Mode    Mode
+	MX      []string
+	MaxAge  time.Duration
+	Fetched time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = make(map[string]*Policy)
+)
+
+// Whether the policy may still be used
+func (p *Policy) valid(now time.Time) bool {
+	return p.Fetched.Add(p.MaxAge).After(now)
+}
+
+// Check whether `host` is an MX host permitted by the policy
+//
+// Patterns may start with a wildcard matching exactly one label, e.g.
+// "*.example.com" matches "mx.example.com" but not "a.mx.example.com".
+func (p *Policy) MatchMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(host, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the current MTA-STS policy of `domain`
+//
+// Policies are cached for their `max_age` and only refetched when the policy
+// id announced in DNS changes. Returns nil if the domain has no policy.
+// An error is returned if a policy is announced but can not be retrieved
+// and no cached policy is available, in which case the domain has to be
+// treated as if it had no policy (RFC 8461 section 5.1).
+func Lookup(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+
+	mu.Lock()
+	cached := cache[domain]
+	mu.Unlock()
+	if cached != nil && !cached.valid(now) {
+		cached = nil
+	}
+
+	id, err := lookupID(ctx, domain)
+	if err != nil {
+		// Keep using a cached policy if DNS is unavailable or the record vanished
+		if cached != nil {
+			zap.S().Debugw("Using cached MTA-STS policy", "domain", domain, "error", err)
+			return cached, nil
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if id == "" {
+		return cached, nil
+	}
+
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			zap.S().Debugw("Using cached MTA-STS policy", "domain", domain, "error", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+	policy.Fetched = now
+
+	zap.S().Debugw("Fetched MTA-STS policy",
+		"domain", domain,
+		"id", policy.ID,
+		"mode", policy.Mode,
+		"mx", policy.MX,
+		"max_age", policy.MaxAge,
+	)
+
+	mu.Lock()
+	cache[domain] = policy
+	mu.Unlock()
+
+	return policy, nil
+}
+
+// Lookup the policy id announced in the `_mta-sts` TXT record of `domain`
+//
+// Returns an empty id if there is no valid STSv1 record.
+func lookupID(ctx context.Context, domain string) (string, error) {
+	txts, err := resolver.Default.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=STSv1") {
+			records = append(records, txt)
+		}
+	}
+	// Multiple records are treated as if there was none (RFC 8461 section 3.1)
+	if len(records) != 1 {
+		return "", nil
+	}
+
+	for _, field := range strings.Split(records[0], ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		if key == "id" {
+			return value, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Fetch and parse the policy file of `domain` over HTTPS
+func fetch(ctx context.Context, domain string) (*Policy, error) {
+	url := fmt.Sprintf("https://mta-sts.%s/.well-known/mta-sts.txt", domain)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching MTA-STS policy: %v", resp.Status)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("unexpected content type for MTA-STS policy: %v", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxPolicySize {
+		return nil, errors.New("MTA-STS policy too large")
+	}
+
+	return parse(string(body))
+}
+
+// Parse the key/value pairs of a policy file (RFC 8461 section 3.2)
+func parse(body string) (*Policy, error) {
+	policy := &Policy{}
+	version := ""
+	hasMaxAge := false
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = Mode(value)
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MTA-STS max_age: %v", value)
+			}
+			policy.MaxAge = min(time.Duration(seconds)*time.Second, maxPolicyAge)
+			hasMaxAge = true
+		}
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported MTA-STS version: %v", version)
+	}
+	if !hasMaxAge {
+		return nil, errors.New("MTA-STS policy without max_age")
+	}
+	switch policy.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("MTA-STS policy without mx")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("invalid MTA-STS mode: %v", policy.Mode)
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,166 @@
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/coronon/pingpong-mail/internal/resolver"
+	"github.com/coronon/pingpong-mail/internal/resolver/resolvertest"
+)
+
+func TestParse(t *testing.T) {
+	policy, err := parse("version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if policy.Mode != ModeEnforce {
+		t.Errorf("mode = %q, want %q", policy.Mode, ModeEnforce)
+	}
+	if len(policy.MX) != 2 {
+		t.Errorf("mx = %v, want 2 patterns", policy.MX)
+	}
+	if policy.MaxAge != 24*time.Hour {
+		t.Errorf("max_age = %v, want 24h", policy.MaxAge)
+	}
+
+	policy, err = parse("version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 99999999999\n")
+	if err == nil {
+		t.Errorf("parse accepted max_age out of range: %+v", policy)
+	}
+
+	invalid := map[string]string{
+		"missing version": "mode: enforce\nmx: mx.example.com\nmax_age: 86400\n",
+		"wrong version":   "version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n",
+		"missing max_age": "version: STSv1\nmode: enforce\nmx: mx.example.com\n",
+		"missing mx":      "version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"invalid mode":    "version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 86400\n",
+	}
+	for name, body := range invalid {
+		if _, err := parse(body); err == nil {
+			t.Errorf("%v: parse succeeded, want error", name)
+		}
+	}
+}
+
+func TestMatchMX(t *testing.T) {
+	policy := &Policy{MX: []string{"mx1.example.com", "*.example.net"}}
+
+	tests := map[string]bool{
+		"mx1.example.com":    true,
+		"MX1.example.com.":   true,
+		"mx2.example.com":    false,
+		"mx.example.net":     true,
+		"example.net":        false,
+		"a.mx.example.net":   false,
+		"mx.example.net.org": false,
+	}
+	for host, want := range tests {
+		if got := policy.MatchMX(host); got != want {
+			t.Errorf("MatchMX(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	txt := "v=STSv1; id=20260101"
+	startDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeTXT && q.Name == "_mta-sts.example.com." {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+				Txt: []string{txt},
+			})
+		} else {
+			resp.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("version: STSv1\nmode: enforce\nmx: *.example.com\nmax_age: 86400\n"))
+	}))
+	t.Cleanup(srv.Close)
+	useServer(t, srv)
+
+	ctx := context.Background()
+
+	policy, err := Lookup(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if policy == nil || policy.ID != "20260101" || !policy.MatchMX("mx.example.com") {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+
+	// Served from cache while the id is unchanged
+	if _, err := Lookup(ctx, "example.com"); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("policy fetched %v times, want 1", fetches)
+	}
+
+	// A new id causes the policy to be refetched
+	txt = "v=STSv1; id=20260102"
+	policy, err = Lookup(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if policy.ID != "20260102" || fetches != 2 {
+		t.Errorf("policy id %q after %v fetches, want refetch", policy.ID, fetches)
+	}
+
+	// Domains without record have no policy
+	policy, err = Lookup(ctx, "example.org")
+	if err != nil || policy != nil {
+		t.Errorf("Lookup without record = %+v, %v, want no policy", policy, err)
+	}
+}
+
+// Serve DNS queries with `handler` and point `resolver.Default` at it
+func startDNS(t *testing.T, handler dns.HandlerFunc) {
+	t.Helper()
+
+	addr := resolvertest.Start(t, handler)
+
+	prev := resolver.Default
+	resolver.Default = &resolver.Resolver{Servers: []string{addr}, Timeout: time.Second}
+	t.Cleanup(func() { resolver.Default = prev })
+}
+
+// Fetch policies from `srv` regardless of the requested host
+func useServer(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network string, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	// The test certificate is issued for example.com only
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    transport.TLSClientConfig.RootCAs,
+		ServerName: "example.com",
+	}
+
+	prev := HTTPClient
+	HTTPClient = &http.Client{
+		Transport:     transport,
+		CheckRedirect: prev.CheckRedirect,
+	}
+	t.Cleanup(func() { HTTPClient = prev })
+}
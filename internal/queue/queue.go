@@ -0,0 +1,463 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/delivery"
+)
+
+// Reply waiting for (another) delivery attempt
+type Job struct {
+	delivery.Message
+
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+var (
+	ErrFull         = errors.New("delivery backlog is full")
+	ErrBusy         = errors.New("all delivery workers are busy")
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+var (
+	mu   sync.Mutex
+	jobs = make(map[string]*Job)
+
+	// Jobs that are due, picked up by the workers
+	due = make(chan *Job)
+
+	// Cancelled on shutdown, no further deliveries are started
+	dispatchCtx, stopDispatch = context.WithCancel(context.Background())
+	// Cancelled once the shutdown grace period expired, aborting all deliveries
+	ctx, abort = context.WithCancel(context.Background())
+
+	workers sync.WaitGroup
+	// Number of deliveries currently in progress
+	active atomic.Int32
+	// Taken for every delivery, queued or synchronous, bounding them to
+	// `delivery_workers` in total
+	slots chan struct{}
+
+	// Synchronous deliveries in progress, no new ones start once stopped
+	syncMu      sync.Mutex
+	syncStopped bool
+	synchronous sync.WaitGroup
+)
+
+// Load persisted replies and schedule them for delivery
+//
+// Must be called AFTER the configuration was initialized.
+func Start() {
+
+	err := os.MkdirAll(config.Cnf.QueueDir, 0o700)
+	if err != nil {
+		zap.S().Fatalw("Could not create queue directory",
+			"queue_dir", config.Cnf.QueueDir,
+			"error", err,
+		)
+	}
+
+	entries, err := os.ReadDir(config.Cnf.QueueDir)
+	if err != nil {
+		zap.S().Fatalw("Could not read queue directory",
+			"queue_dir", config.Cnf.QueueDir,
+			"error", err,
+		)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(config.Cnf.QueueDir, entry.Name())
+
+		//? Left behind by a crash while saving, the previous version is intact
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json.tmp") {
+			if err := os.Remove(path); err != nil {
+				zap.S().Infow("Could not remove stale queue entry", "path", path, "error", err)
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		job, err := load(path)
+		if err != nil {
+			zap.S().Infow("Skipping unreadable queue entry", "path", path, "error", err)
+			continue
+		}
+
+		schedule(job)
+	}
+
+	slots = make(chan struct{}, config.Cnf.DeliveryWorkers)
+	workers.Add(config.Cnf.DeliveryWorkers)
+	for range config.Cnf.DeliveryWorkers {
+		go worker()
+	}
+
+	zap.S().Infow("Queue started",
+		"queue_dir", config.Cnf.QueueDir,
+		"jobs", len(jobs),
+		"workers", config.Cnf.DeliveryWorkers,
+	)
+}
+
+// Stop delivering replies, giving deliveries in progress up to `grace` to
+// complete
+//
+// Deliveries still in progress afterwards are aborted. Every queued reply that
+// was not delivered remains on disk and is delivered after the next start.
+func Shutdown(grace time.Duration) {
+	stopDispatch()
+	syncMu.Lock()
+	syncStopped = true
+	syncMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		synchronous.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		zap.S().Infow("Aborting deliveries after shutdown grace period",
+			"active", active.Load(),
+		)
+		abort()
+		<-done
+	}
+
+	mu.Lock()
+	pending := len(jobs)
+	mu.Unlock()
+
+	zap.S().Infow("Queue stopped", "pending", pending, "queue_dir", config.Cnf.QueueDir)
+}
+
+// Whether the backlog is exhausted and no further replies are accepted
+func Full() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return len(jobs) >= config.Cnf.DeliveryBacklog
+}
+
+// Persist a new reply and attempt to deliver it as soon as a worker is free
+//
+// Returns `ErrFull` if the backlog is exhausted.
+func Enqueue(msg delivery.Message) error {
+	now := time.Now()
+	job := &Job{
+		Message:     msg,
+		Created:     now,
+		NextAttempt: now,
+	}
+
+	//? Reserve the slot first, so concurrent sessions can't exceed the backlog
+	mu.Lock()
+	if len(jobs) >= config.Cnf.DeliveryBacklog {
+		mu.Unlock()
+		return ErrFull
+	}
+	jobs[job.ID] = job
+	mu.Unlock()
+
+	if err := save(job); err != nil {
+		mu.Lock()
+		delete(jobs, job.ID)
+		mu.Unlock()
+		return err
+	}
+
+	wait(job)
+
+	return nil
+}
+
+// Deliver `msg` right away instead of queueing it
+//
+// Shares the `delivery_workers` and `delivery_workers_per_mx` limits with
+// queued replies, waiting at most `timeout` for free slots and the delivery
+// together. Aborted like queued
+// deliveries once the shutdown grace period expired, the reply is abandoned
+// then.
+func DeliverNow(timeout time.Duration, msg *delivery.Message) error {
+	syncMu.Lock()
+	if syncStopped {
+		syncMu.Unlock()
+		return &delivery.Error{Temporary: true, Err: ErrShuttingDown}
+	}
+	synchronous.Add(1)
+	syncMu.Unlock()
+	defer synchronous.Done()
+
+	deliverCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-deliverCtx.Done():
+			return &delivery.Error{Temporary: true, Err: ErrBusy}
+		}
+		active.Add(1)
+		err = delivery.Deliver(deliverCtx, msg)
+		active.Add(-1)
+		<-slots
+
+		//? Wait for the remote host without holding a worker slot
+		var busy *delivery.HostBusyError
+		if !errors.As(err, &busy) || delivery.WaitHost(deliverCtx, busy.Host) != nil {
+			break
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		zap.S().Infow("Abandoned synchronous reply on shutdown", "id", msg.ID, "to", msg.To, "error", err)
+		return &delivery.Error{Temporary: true, Err: ErrShuttingDown}
+	}
+
+	return err
+}
+
+// Track `job` and attempt delivery once it is due
+func schedule(job *Job) {
+	mu.Lock()
+	jobs[job.ID] = job
+	mu.Unlock()
+
+	wait(job)
+}
+
+// Hand `job` to the workers once it is due
+func wait(job *Job) {
+	time.AfterFunc(time.Until(job.NextAttempt), func() {
+		select {
+		case due <- job:
+		case <-dispatchCtx.Done():
+		}
+	})
+}
+
+// Deliver due jobs until shutdown
+func worker() {
+	defer workers.Done()
+
+	for {
+		select {
+		case job := <-due:
+			if dispatchCtx.Err() != nil {
+				return
+			}
+			//? Synchronous deliveries may hold slots as well
+			select {
+			case slots <- struct{}{}:
+			case <-dispatchCtx.Done():
+				return
+			}
+			active.Add(1)
+			attempt(job)
+			active.Add(-1)
+			<-slots
+		case <-dispatchCtx.Done():
+			return
+		}
+	}
+}
+
+// Attempt to deliver `job`, rescheduling it on temporary failures
+func attempt(job *Job) {
+	err := delivery.Deliver(ctx, &job.Message)
+
+	//? Nothing was attempted, free the worker for other hosts meanwhile
+	var busy *delivery.HostBusyError
+	if errors.As(err, &busy) {
+		zap.S().Debugw("Remote host busy, waiting for a free connection", "to", job.To, "host", busy.Host)
+		go func() {
+			if delivery.WaitHost(dispatchCtx, busy.Host) == nil {
+				job.NextAttempt = time.Now()
+				wait(job)
+			}
+		}()
+		return
+	}
+
+	job.Attempts++
+	if err == nil {
+		zap.S().Infow("Sent reply", "to", job.To, "attempts", job.Attempts)
+		remove(job)
+		return
+	}
+
+	//? Aborted by shutdown, the remote did not reject anything
+	if ctx.Err() != nil {
+		zap.S().Infow("Delivery aborted by shutdown, keeping reply for next start",
+			"to", job.To,
+			"attempts", job.Attempts,
+		)
+		job.LastError = err.Error()
+		if err := save(job); err != nil {
+			zap.S().Infow("Abandoned reply, could not persist queue entry",
+				"id", job.ID,
+				"to", job.To,
+				"error", err,
+			)
+		}
+		return
+	}
+
+	//? Permanent failures are never retried, that could be seen as 'spammy'
+	if !delivery.IsTemporary(err) {
+		zap.S().Infow("Dropped reply after permanent failure",
+			"to", job.To,
+			"attempts", job.Attempts,
+			"error", err,
+		)
+		remove(job)
+		return
+	}
+
+	now := time.Now()
+	next := now.Add(backoff(job.Attempts))
+	maxAge := time.Duration(config.Cnf.QueueMaxAge) * time.Second
+	if next.Sub(job.Created) > maxAge {
+		zap.S().Infow("Dropped reply after exceeding maximum age",
+			"to", job.To,
+			"attempts", job.Attempts,
+			"error", err,
+		)
+		remove(job)
+		return
+	}
+
+	zap.S().Debugw("Delivery failed temporarily, retrying later",
+		"to", job.To,
+		"attempts", job.Attempts,
+		"next_attempt", next,
+		"error", err,
+	)
+
+	job.NextAttempt = next
+	job.LastError = err.Error()
+	if err := save(job); err != nil {
+		zap.S().Infow("Could not persist queue entry", "id", job.ID, "error", err)
+	}
+
+	wait(job)
+}
+
+// Delay before the next attempt, doubling with every attempt
+func backoff(attempts int) time.Duration {
+	delay := time.Duration(config.Cnf.QueueRetryMin) * time.Second
+	maxDelay := time.Duration(config.Cnf.QueueRetryMax) * time.Second
+
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxDelay)
+}
+
+// Path of the file persisting `job`
+func jobPath(job *Job) string {
+	return filepath.Join(config.Cnf.QueueDir, job.ID+".json")
+}
+
+// Atomically and durably write `job` to disk
+//
+// Only returns once the entry survives a crash, as the incoming email is
+// accepted afterwards.
+func save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	path := jobPath(job)
+	tmpPath := path + ".tmp"
+	if err := writeSynced(tmpPath, data); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	//? The rename itself is only durable once the directory is synced
+	return syncDir(config.Cnf.QueueDir)
+}
+
+// Write `data` to a new file at `path` and flush it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Flush the entries of the directory at `path` to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+
+	return dir.Sync()
+}
+
+// Read a persisted job from `path`
+func load(path string) (*Job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Stop tracking `job` and delete it from disk
+func remove(job *Job) {
+	mu.Lock()
+	delete(jobs, job.ID)
+	mu.Unlock()
+
+	err := os.Remove(jobPath(job))
+	if err != nil && !os.IsNotExist(err) {
+		zap.S().Infow("Could not remove queue entry", "id", job.ID, "error", err)
+	}
+}
@@ -0,0 +1,224 @@
+package reply
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Maximum depth of nested multipart entities that is decoded
+const maxMIMEDepth = 8
+
+var errNoTextPart = errors.New("no text part found")
+
+// Readable text of an email body with `header`, decoded to UTF-8
+//
+// Multipart bodies are searched for the first text/plain part, falling back
+// to the first text/html part converted to text. Transfer encodings and
+// charsets are decoded. Bodies that can't be decoded are returned as is.
+func DecodeBody(header textproto.MIMEHeader, body []byte) string {
+	text, isHTML, err := textPart(header, bytes.NewReader(body), 0)
+	if err != nil {
+		return strings.ToValidUTF8(string(body), "�")
+	}
+
+	if isHTML {
+		text = htmlToText(text)
+	}
+
+	return text
+}
+
+// Find the text of the entity with `header` and `body`
+//
+// Returns whether the text is HTML rather than plain text.
+func textPart(header textproto.MIMEHeader, body io.Reader, depth int) (string, bool, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		//? RFC 2045 §5.2 default
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxMIMEDepth || params["boundary"] == "" {
+			return "", false, errNoTextPart
+		}
+		return multipartText(multipart.NewReader(body, params["boundary"]), depth)
+	case mediaType == "text/plain", mediaType == "text/html":
+		text, err := decodeText(header, params["charset"], body)
+		return text, mediaType == "text/html", err
+	default:
+		return "", false, errNoTextPart
+	}
+}
+
+// Find the text of the first text/plain (or else text/html) part of `reader`
+func multipartText(reader *multipart.Reader, depth int) (string, bool, error) {
+	var htmlText string
+	foundHTML := false
+
+	for {
+		//? NextRawPart as NextPart only decodes quoted-printable
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		if isAttachment(part.Header) {
+			continue
+		}
+
+		text, isHTML, err := textPart(part.Header, part, depth+1)
+		if err != nil {
+			continue
+		}
+		if !isHTML {
+			return text, false, nil
+		}
+		if !foundHTML {
+			htmlText, foundHTML = text, true
+		}
+	}
+
+	if foundHTML {
+		return htmlText, true, nil
+	}
+	return "", false, errNoTextPart
+}
+
+// Whether the entity with `header` is an attachment rather than content
+func isAttachment(header textproto.MIMEHeader) bool {
+	disposition, _, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	return err == nil && disposition == "attachment"
+}
+
+// Decode the transfer encoding and `charsetLabel` of `body` to UTF-8
+func decodeText(header textproto.MIMEHeader, charsetLabel string, body io.Reader) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	text, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	//? The WHATWG label table maps us-ascii to windows-1252, which would garble
+	//? UTF-8 sent without (or with a lazy) charset parameter
+	if !utf8.Valid(text) || !isUTF8Compatible(charsetLabel) {
+		if decoded, err := charset.NewReaderLabel(charsetLabel, bytes.NewReader(text)); err == nil {
+			if converted, err := io.ReadAll(decoded); err == nil {
+				text = converted
+			}
+		}
+	}
+
+	return strings.ToValidUTF8(string(text), "�"), nil
+}
+
+// Whether valid UTF-8 text labelled with `charsetLabel` can be used as is
+func isUTF8Compatible(charsetLabel string) bool {
+	switch strings.ToLower(strings.TrimSpace(charsetLabel)) {
+	case "", "us-ascii", "ascii", "utf-8", "utf8":
+		return true
+	default:
+		return false
+	}
+}
+
+// Elements whose content is never displayed
+var hiddenElements = map[string]bool{
+	"head":     true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"title":    true,
+}
+
+// Elements starting a new line
+var blockElements = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true,
+	"div": true, "dl": true, "dt": true, "dd": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// Convert `document` to plain text, keeping line breaks of block elements
+func htmlToText(document string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	out := new(strings.Builder)
+	hidden := 0
+
+	for {
+		switch tokenType := tokenizer.Next(); tokenType {
+		case html.ErrorToken:
+			return collapseBlankLines(out.String())
+		case html.TextToken:
+			if hidden == 0 {
+				out.WriteString(strings.Join(strings.Fields(string(tokenizer.Text())), " "))
+				out.WriteByte(' ')
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			//? Self-closing tags have no end tag that would end the hidden content,
+			//? nor is the markup following e.g. `<script/>` its raw text
+			if tokenType == html.SelfClosingTagToken {
+				tokenizer.NextIsNotRawText()
+			} else if hiddenElements[string(name)] {
+				hidden++
+			}
+			if blockElements[string(name)] {
+				out.WriteByte('\n')
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if hiddenElements[string(name)] && hidden > 0 {
+				hidden--
+			}
+			if blockElements[string(name)] {
+				out.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// Trim all lines of `text`, allowing at most one empty line in a row
+func collapseBlankLines(text string) string {
+	out := new(strings.Builder)
+	blank := true
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank {
+				out.WriteByte('\n')
+			}
+			blank = true
+			continue
+		}
+
+		out.WriteString(line)
+		out.WriteByte('\n')
+		blank = false
+	}
+
+	return strings.TrimRight(out.String(), "\n")
+}
@@ -0,0 +1,85 @@
+package reply
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	multipartHeader := textproto.MIMEHeader{"Content-Type": {`multipart/alternative; boundary="b"`}}
+
+	tests := []struct {
+		name   string
+		header textproto.MIMEHeader
+		body   string
+		want   string
+	}{
+		{"no content type", textproto.MIMEHeader{}, "Grüße aus München", "Grüße aus München"},
+		{"us-ascii label", textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}}, "Grüße", "Grüße"},
+		{"utf-8", textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}}, "日本語", "日本語"},
+		{"latin-1", textproto.MIMEHeader{"Content-Type": {"text/plain; charset=iso-8859-1"}}, "caf\xe9", "café"},
+		{"latin-1 valid utf-8", textproto.MIMEHeader{"Content-Type": {"text/plain; charset=iso-8859-1"}}, "\xc3\xbc", "Ã¼"},
+		{"unlabelled 8bit", textproto.MIMEHeader{}, "caf\xe9", "café"},
+		{
+			"quoted-printable latin-1",
+			textproto.MIMEHeader{
+				"Content-Type":              {"text/plain; charset=iso-8859-1"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			},
+			"Gr=FC=DFe",
+			"Grüße",
+		},
+		{
+			"base64",
+			textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Transfer-Encoding": {"Base64"}},
+			"SGFsbMO2Cg==",
+			"Hallö\n",
+		},
+		{"html", textproto.MIMEHeader{"Content-Type": {"text/html"}}, "<p>Hello</p><p>World</p>", "Hello\n\nWorld"},
+		{
+			"multipart prefers plain text",
+			multipartHeader,
+			"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--b\r\nContent-Type: text/plain\r\n\r\nplain\r\n--b--\r\n",
+			"plain",
+		},
+		{
+			"multipart html fallback",
+			multipartHeader,
+			"--b\r\nContent-Type: image/png\r\n\r\npng\r\n--b\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n--b--\r\n",
+			"html",
+		},
+		{
+			"multipart skips attachments",
+			multipartHeader,
+			"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment\r\n\r\nfile\r\n--b\r\nContent-Type: text/plain\r\n\r\nbody\r\n--b--\r\n",
+			"body",
+		},
+		{"not text", textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}}, "raw\xff", "raw�"},
+	}
+
+	for _, test := range tests {
+		if got := DecodeBody(test.header, []byte(test.body)); got != test.want {
+			t.Errorf("%v: DecodeBody = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		document string
+		want     string
+	}{
+		{"<p>Hello</p><p>World</p>", "Hello\n\nWorld"},
+		{"<html><head><title>T</title><style>p{}</style></head><body>Hi<br>there</body></html>", "Hi\nthere"},
+		{"<div>a   b\n c</div>\n\n\n<div>d</div>", "a b c\n\nd"},
+		{"<script/>visible<p>x</p>", "visible\nx"},
+		{"<script>hidden()</script><template>t</template>x", "x"},
+		{"Tom &amp; Jerry &lt;3", "Tom & Jerry <3"},
+	}
+
+	for _, test := range tests {
+		if got := htmlToText(test.document); got != test.want {
+			t.Errorf("htmlToText(%q) = %q, want %q", test.document, got, test.want)
+		}
+	}
+}
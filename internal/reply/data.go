@@ -0,0 +1,107 @@
+package reply
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/dmarc"
+	"github.com/coronon/pingpong-mail/internal/resolver"
+	"github.com/coronon/pingpong-mail/internal/transit"
+)
+
+// Data available to the reply templates
+//
+// Fields and methods are accessed from templates by their name, e.g.
+// `{{.Sender}}` or `{{.PeerName}}`.
+type TemplateData struct {
+	// Name of the profile applied to the recipient inbox
+	Profile string
+	// Envelope sender (MAIL FROM) of the received email
+	Sender string
+	// Address of the <From:> header of the received email (the reply's recipient)
+	From string
+	// Envelope recipient (RCPT TO) of the received email
+	Recipient string
+	// Subject of the received email, decoded and sanitised to a single line
+	Subject string
+	// Readable text of the received email's body, decoded to UTF-8 and
+	// limited to `reply_original_body_max_length` characters
+	Body string
+	// Body of the received email exactly as received
+	RawBody string
+	// IP address of the SMTP client that delivered the received email
+	PeerIP string
+	// Name the SMTP client used in its HELO/EHLO command
+	Helo string
+	// TLS version and cipher suite of the SMTP session, empty without TLS
+	TLSVersion string
+	TLSCipher  string
+	// Size of the received email in bytes
+	Size int
+	// Time the received email was accepted
+	Received time.Time
+	// Time the reply is built
+	Now time.Time
+	// Outcome of the SPF, DKIM and DMARC checks, empty if DMARC is disabled
+	Auth dmarc.Result
+	// Time the received email took to reach us, per relay
+	Transit *transit.Transit
+
+	peerNameOnce sync.Once
+	peerName     string
+}
+
+// Build the template data for an email received from `peer`
+func NewTemplateData(peer *smtpd.Peer, env *smtpd.Envelope, received time.Time) *TemplateData {
+	data := &TemplateData{
+		Sender:   env.Sender,
+		Helo:     peer.HeloName,
+		Size:     len(env.Data),
+		Received: received.UTC(),
+		Now:      time.Now().UTC(),
+	}
+
+	if len(env.Recipients) > 0 {
+		data.Recipient = env.Recipients[0]
+	}
+
+	if tcpAddr, ok := peer.Addr.(*net.TCPAddr); ok {
+		data.PeerIP = tcpAddr.IP.String()
+	}
+
+	if peer.TLS != nil {
+		data.TLSVersion = tls.VersionName(peer.TLS.Version)
+		data.TLSCipher = tls.CipherSuiteName(peer.TLS.CipherSuite)
+	}
+
+	return data
+}
+
+// Reverse DNS name of the SMTP client, empty if it has none
+//
+// Only looked up if a template uses it.
+func (d *TemplateData) PeerName() string {
+	d.peerNameOnce.Do(func() {
+		if d.PeerIP == "" {
+			return
+		}
+
+		timeout := time.Duration(config.Cnf.DNSTimeout) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		names, err := resolver.Default.LookupAddr(ctx, d.PeerIP)
+		if err == nil && len(names) > 0 {
+			d.peerName = strings.TrimSuffix(names[0], ".")
+		}
+	})
+
+	return d.peerName
+}
@@ -0,0 +1,71 @@
+package reply
+
+import (
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Helper functions available to the reply templates
+//
+// None of them has side effects or access to anything but their arguments.
+var funcs = template.FuncMap{
+	"date":     date,
+	"duration": duration,
+	"truncate": truncate,
+	"quote":    quote,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"replace":  strings.ReplaceAll,
+	"default":  defaultValue,
+}
+
+// Format `t` using the Go reference `layout`, e.g. `2006-01-02 15:04`
+func date(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+// Human readable duration, rounded to milliseconds
+func duration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// Shorten `text` to at most `maxLength` characters, e.g. a decoded body
+func Truncate(maxLength int, text string) string {
+	return truncate(maxLength, text)
+}
+
+// Shorten `s` to at most `n` characters, marking it with "..." if shortened
+func truncate(n int, s string) string {
+	if n < 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	runes := []rune(s)
+	if n <= 3 {
+		return string(runes[:n])
+	}
+
+	return string(runes[:n-3]) + "..."
+}
+
+// Prefix every line of `s` with "> ", as customary for quoted replies
+func quote(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "> " + strings.TrimRight(line, "\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// `value` or `fallback` if `value` is empty
+func defaultValue(fallback string, value string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
@@ -1,26 +1,175 @@
 package reply
 
 import (
+	"fmt"
+	htmltemplate "html/template"
 	"io"
-	"net/mail"
+	"mime"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"text/template"
+
+	"go.uber.org/zap"
 
 	"github.com/coronon/pingpong-mail/internal/config"
 )
 
-// Build the subject for the response to `original`
-func BuildReplySubject(original string) string {
-	return strings.ReplaceAll(config.Cnf.ReplySubject, "{ORIG_SUBJ}", original)
+// Legacy placeholders and the template actions replacing them
+var legacyPlaceholders = strings.NewReplacer(
+	"{ORIG_SUBJ}", "{{.Subject}}",
+	"{ORIG_BODY}", "{{.Body}}",
+	"{TIME}", `{{date "2006-01-02T15:04:05Z07:00" .Now}}`,
+)
+
+// Image embedded in HTML replies
+type Image struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
+// Parsed reply templates of a profile
+type templates struct {
+	subject *template.Template
+	body    *template.Template
+	// nil if replies are plain text only
+	html *htmltemplate.Template
+}
+
+var (
+	// Templates by profile name
+	profileTemplates = make(map[string]*templates)
+
+	// Images embedded in HTML replies
+	Images []Image
+)
+
+// Parse the reply templates of all profiles and read the inline images
+//
+// Must be called AFTER the configuration was initialized.
+func LoadTemplates() {
+	loadProfileTemplates(&config.Cnf.Profile)
+	for i := range config.Cnf.Profiles {
+		loadProfileTemplates(&config.Cnf.Profiles[i].Profile)
+	}
+
+	for _, img := range config.Cnf.ReplyInlineImages {
+		data, err := os.ReadFile(img.Path)
+		if err != nil {
+			zap.S().Fatalw("Error reading inline image", "path", img.Path, "error", err)
+		}
+
+		Images = append(Images, Image{
+			Name: img.Name,
+			// Empty -> detected from the content
+			MimeType: mime.TypeByExtension(filepath.Ext(img.Path)),
+			Data:     data,
+		})
+	}
+}
+
+// Parse the reply templates of `profile`
+func loadProfileTemplates(profile *config.Profile) {
+	var err error
+	t := &templates{}
+
+	t.subject, err = parseTemplate("reply_subject", profile.ReplySubject)
+	if err != nil {
+		zap.S().Fatalw("Error parsing reply subject template", "profile", profile.Name, "error", err)
+	}
+
+	t.body, err = parseTemplate("reply_message", profile.ReplyMessage)
+	if err != nil {
+		zap.S().Fatalw("Error parsing reply message template", "profile", profile.Name, "error", err)
+	}
+
+	if profile.ReplyMessageHTML != "" {
+		t.html, err = htmltemplate.New("reply_message_html").
+			Funcs(htmltemplate.FuncMap(funcs)).
+			Option("missingkey=error").
+			Parse(legacyPlaceholders.Replace(profile.ReplyMessageHTML))
+		if err != nil {
+			zap.S().Fatalw("Error parsing HTML reply message template",
+				"profile", profile.Name,
+				"error", err,
+			)
+		}
+	}
+
+	profileTemplates[profile.Name] = t
+}
+
+// Templates of the profile of `data`
+func templatesFor(data *TemplateData) (*templates, error) {
+	t, ok := profileTemplates[data.Profile]
+	if !ok {
+		return nil, fmt.Errorf("no templates for profile %q", data.Profile)
+	}
+
+	return t, nil
+}
+
+// Parse `text` as template, converting legacy placeholders
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).
+		Funcs(funcs).
+		Option("missingkey=error").
+		Parse(legacyPlaceholders.Replace(text))
+}
+
+// Build the subject for the response described by `data`
+//
+// The subject is sanitised to a single line, encoding it is up to the caller.
+func BuildReplySubject(data *TemplateData) (string, error) {
+	t, err := templatesFor(data)
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := execute(t.subject, data)
+	if err != nil {
+		return "", err
+	}
+
+	return truncate(maxSubjectLength, sanitizeHeaderValue(subject)), nil
+}
+
+// Build the body for the response described by `data`
+func BuildReplyBody(data *TemplateData) (string, error) {
+	t, err := templatesFor(data)
+	if err != nil {
+		return "", err
+	}
+
+	return execute(t.body, data)
+}
+
+// Build the HTML body for the response described by `data`
+//
+// Returns an empty string if no HTML template is configured.
+func BuildReplyHTML(data *TemplateData) (string, error) {
+	t, err := templatesFor(data)
+	if err != nil || t.html == nil {
+		return "", err
+	}
+
+	return execute(t.html, data)
+}
+
+// Template that can be executed, either text/template or html/template
+type executable interface {
+	Name() string
+	Execute(w io.Writer, data any) error
 }
 
-// Build the body for the response to `email`
-func BuildReplyBody(email *mail.Message) string {
-	origMsg := new(strings.Builder)
-	io.Copy(origMsg, email.Body)
+// Execute `tmpl` with `data`
+func execute(tmpl executable, data *TemplateData) (string, error) {
+	out := new(strings.Builder)
 
-	body := strings.ReplaceAll(config.Cnf.ReplyMessage, "{ORIG_BODY}", origMsg.String())
-	body = strings.ReplaceAll(body, "{TIME}", time.Now().UTC().Format(time.RFC3339))
+	if err := tmpl.Execute(out, data); err != nil {
+		return "", fmt.Errorf("executing template %v: %w", tmpl.Name(), err)
+	}
 
-	return body
+	return out.String(), nil
 }
@@ -0,0 +1,84 @@
+package reply
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Human readable report of the authentication checks of the received email
+//
+// Explains which SPF, DKIM and DMARC results led to the email being accepted
+// and how the SMTP session was encrypted. Available as `{{.AuthReport}}`.
+func (d *TemplateData) AuthReport() string {
+	b := new(strings.Builder)
+
+	if d.TLSVersion != "" {
+		fmt.Fprintf(b, "TLS:   %v, %v\n", d.TLSVersion, d.TLSCipher)
+	} else {
+		fmt.Fprintln(b, "TLS:   none")
+	}
+
+	auth := &d.Auth
+	if auth.DMARC == "" {
+		fmt.Fprintln(b, "DMARC: not checked")
+		return b.String()
+	}
+
+	fmt.Fprintf(b, "SPF:   %v for %v (envelope sender), %v\n",
+		defaultValue("not checked", auth.SPF),
+		defaultValue("-", auth.SPFDomain),
+		alignment(auth.SPFAligned, auth.SPFAlignment),
+	)
+
+	if len(auth.DKIMSignatures) == 0 {
+		fmt.Fprintf(b, "DKIM:  %v\n", defaultValue("not checked", auth.DKIM))
+	}
+	for i, sig := range auth.DKIMSignatures {
+		label := "DKIM:  "
+		if i > 0 {
+			label = "       "
+		}
+
+		keySize := "unknown key size"
+		if size := sig.KeySize(); size > 0 {
+			keySize = fmt.Sprintf("%v bit key", size)
+		}
+
+		fmt.Fprintf(b, "%v%v d=%v s=%v a=%v (%v), %v",
+			label,
+			sig.Result,
+			defaultValue("-", sig.Domain),
+			defaultValue("-", sig.Selector),
+			defaultValue("-", sig.Algorithm),
+			keySize,
+			alignment(sig.Aligned, auth.DKIMAlignment),
+		)
+		if sig.Error != "" {
+			fmt.Fprintf(b, ": %v", sig.Error)
+		}
+		fmt.Fprintln(b)
+	}
+
+	fmt.Fprintf(b, "DMARC: %v, policy %v of %v\n",
+		auth.DMARC,
+		defaultValue("-", auth.Policy),
+		defaultValue("-", auth.Domain),
+	)
+	if auth.Record != "" {
+		fmt.Fprintf(b, "       %v\n", auth.Record)
+	}
+
+	return b.String()
+}
+
+// Describe whether a check is aligned under `mode`
+func alignment(aligned bool, mode string) string {
+	if mode == "" {
+		mode = "relaxed"
+	}
+
+	if aligned {
+		return fmt.Sprintf("aligned (%v)", mode)
+	}
+	return fmt.Sprintf("not aligned (%v)", mode)
+}
@@ -0,0 +1,48 @@
+package reply
+
+import (
+	"mime"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// Maximum number of characters of a received subject used in replies
+	maxOrigSubjectLength = 200
+	// Maximum number of characters of a reply subject
+	maxSubjectLength = 500
+)
+
+// Decodes RFC 2047 encoded words in any charset known to x/net
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// Decode a received `Subject` header to a sanitised, length limited string
+//
+// Encoded words (RFC 2047) are decoded, subjects that can't be decoded are
+// used as is.
+func DecodeSubject(raw string) string {
+	decoded, err := wordDecoder.DecodeHeader(raw)
+	if err != nil {
+		decoded = raw
+	}
+
+	return truncate(maxOrigSubjectLength, sanitizeHeaderValue(decoded))
+}
+
+// Remove everything from `value` that could break out of a header field
+//
+// Control characters (including CR and LF) and Unicode line separators are
+// replaced by spaces, runs of whitespace are collapsed.
+func sanitizeHeaderValue(value string) string {
+	value = strings.ToValidUTF8(value, "�")
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return ' '
+		}
+		return r
+	}, value)
+
+	return strings.Join(strings.Fields(value), " ")
+}
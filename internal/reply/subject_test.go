@@ -0,0 +1,37 @@
+package reply
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDecodeSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"plain", "PING hello", "PING hello"},
+		{"utf-8 q-encoding", "=?UTF-8?q?Gr=C3=BC=C3=9Fe?=", "Grüße"},
+		{"utf-8 b-encoding", "=?utf-8?B?5pel5pys6Kqe?=", "日本語"},
+		{"latin-1", "=?ISO-8859-1?Q?caf=E9?=", "café"},
+		{"adjacent words", "=?UTF-8?q?a?= =?UTF-8?q?b?=", "ab"},
+		{"mixed", "Re: =?UTF-8?q?M=C3=BCnchen?= trip", "Re: München trip"},
+		{"unknown charset", "=?x-unknown?q?abc?=", "=?x-unknown?q?abc?="},
+		{"header injection", "=?UTF-8?q?a=0D=0ABcc:_evil@example.com?=", "a Bcc: evil@example.com"},
+		{"line separator", "a b\tc", "a b c"},
+		{"raw 8bit", "caf\xe9", "caf�"},
+	}
+
+	for _, test := range tests {
+		if got := DecodeSubject(test.raw); got != test.want {
+			t.Errorf("%v: DecodeSubject(%q) = %q, want %q", test.name, test.raw, got, test.want)
+		}
+	}
+
+	long := DecodeSubject(strings.Repeat("ü", 300))
+	if n := utf8.RuneCountInString(long); n != maxOrigSubjectLength || !strings.HasSuffix(long, "...") {
+		t.Errorf("long subject has %v characters (%q), want %v ending in ...", n, long, maxOrigSubjectLength)
+	}
+}
@@ -0,0 +1,384 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/coronon/pingpong-mail/internal/config"
+)
+
+// How long answers without records are cached if the SOA doesn't say otherwise
+const defaultNegativeTTL = 60 * time.Second
+
+// Resolver used for all DNS lookups of the application
+//
+// Replace it to resolve against different servers, e.g. a local stub server.
+var Default = &Resolver{}
+
+// DNS resolver querying a fixed set of nameservers
+//
+// Its lookup methods mirror those of `net.Resolver` and return `*net.DNSError`
+// with the same semantics, so it can be used in place of it (e.g. as
+// `spf.DNSResolver`).
+type Resolver struct {
+	// Nameservers as "host:port"
+	Servers []string
+	// Use DNS-over-TLS (RFC 7858)
+	TLS bool
+	// Name the certificate of DNS-over-TLS servers is verified against
+	TLSServerName string
+	// Timeout of a single query, 0 for the `miekg/dns` default
+	Timeout time.Duration
+	// Maximum number of cached answers, 0 disables caching
+	CacheSize int
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// Configure the `Default` resolver
+//
+// Must be called AFTER the configuration was initialized.
+func Setup() {
+	port := "53"
+	if config.Cnf.DNSOverTLS {
+		port = "853"
+	}
+
+	var servers []string
+	for _, server := range config.Cnf.DNSNameservers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, port)
+		}
+		servers = append(servers, server)
+	}
+
+	// Fall back to the system configuration
+	if len(servers) == 0 {
+		clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			zap.S().Fatalw("Could not read system resolver configuration", "error", err)
+		}
+		for _, server := range clientConfig.Servers {
+			servers = append(servers, net.JoinHostPort(server, clientConfig.Port))
+		}
+	}
+
+	Default = &Resolver{
+		Servers:       servers,
+		TLS:           config.Cnf.DNSOverTLS,
+		TLSServerName: config.Cnf.DNSTLSServerName,
+		Timeout:       time.Duration(config.Cnf.DNSTimeout) * time.Second,
+		CacheSize:     config.Cnf.DNSCacheSize,
+	}
+
+	zap.S().Debugw("DNS resolver configured",
+		"servers", servers,
+		"tls", Default.TLS,
+		"cache_size", Default.CacheSize,
+	)
+}
+
+// Query records of `qtype` for `name`, requesting DNSSEC validation
+//
+// Successful answers (including NXDOMAIN) are cached for their TTL.
+func (r *Resolver) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	name = dns.Fqdn(name)
+	key := cacheKey{strings.ToLower(name), qtype}
+
+	if msg := r.cached(key); msg != nil {
+		return msg, nil
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.SetEdns0(4096, true)
+	query.AuthenticatedData = true
+
+	var lastErr error
+	for _, server := range r.Servers {
+		resp, err := r.exchange(ctx, query, server)
+		if err != nil {
+			lastErr = &net.DNSError{
+				Err:         err.Error(),
+				Name:        name,
+				Server:      server,
+				IsTimeout:   errors.Is(err, context.DeadlineExceeded) || isTimeout(err),
+				IsTemporary: true,
+			}
+			continue
+		}
+
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = &net.DNSError{
+				Err:         "server misbehaving: " + dns.RcodeToString[resp.Rcode],
+				Name:        name,
+				Server:      server,
+				IsTemporary: true,
+			}
+			continue
+		}
+
+		r.store(key, resp)
+		return resp, nil
+	}
+
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no nameservers configured", Name: name}
+	}
+	return nil, lastErr
+}
+
+// Send `query` to `server`, retrying over TCP if the UDP answer was truncated
+func (r *Resolver) exchange(ctx context.Context, query *dns.Msg, server string) (*dns.Msg, error) {
+	if r.TLS {
+		client := &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   r.Timeout,
+			TLSConfig: &tls.Config{ServerName: r.TLSServerName},
+		}
+		resp, _, err := client.ExchangeContext(ctx, query, server)
+		return resp, err
+	}
+
+	resp, _, err := (&dns.Client{Timeout: r.Timeout}).ExchangeContext(ctx, query, server)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp", Timeout: r.Timeout}).ExchangeContext(ctx, query, server)
+	}
+
+	return resp, err
+}
+
+// Get a cached, unexpired answer for `key`
+func (r *Resolver) cached(key cacheKey) *dns.Msg {
+	if r.CacheSize <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil
+	}
+
+	return entry.msg
+}
+
+// Cache `msg` as answer for `key` for its TTL
+func (r *Resolver) store(key cacheKey, msg *dns.Msg) {
+	if r.CacheSize <= 0 {
+		return
+	}
+
+	ttl := answerTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil {
+		r.cache = make(map[cacheKey]cacheEntry)
+	}
+
+	// Make room by evicting expired entries, or an arbitrary one if none expired
+	if len(r.cache) >= r.CacheSize {
+		now := time.Now()
+		for k, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < r.CacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+
+	r.cache[key] = cacheEntry{msg: msg, expires: time.Now().Add(ttl)}
+}
+
+// Lowest TTL of the answer, or the negative caching TTL (RFC 2308) if empty
+func answerTTL(msg *dns.Msg) time.Duration {
+	if len(msg.Answer) == 0 {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			}
+		}
+		return defaultNegativeTTL
+	}
+
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// Query `name` and collect the answer records of type `T`
+//
+// Like `net.Resolver`, a missing domain or empty answer is reported as not
+// found error.
+func lookup[T dns.RR](ctx context.Context, r *Resolver, name string, qtype uint16) ([]T, *dns.Msg, error) {
+	resp, err := r.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []T
+	for _, rr := range resp.Answer {
+		if record, ok := rr.(T); ok {
+			records = append(records, record)
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, resp, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return records, resp, nil
+}
+
+// Lookup TXT records of `name`, concatenating the strings of each record
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, _, err := lookup[*dns.TXT](ctx, r, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(records))
+	for _, record := range records {
+		txts = append(txts, strings.Join(record.Txt, ""))
+	}
+
+	return txts, nil
+}
+
+// Lookup MX records of `name`, sorted by preference
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, _, err := lookup[*dns.MX](ctx, r, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		mxs = append(mxs, &net.MX{Host: record.Mx, Pref: record.Preference})
+	}
+	slices.SortStableFunc(mxs, func(a, b *net.MX) int { return int(a.Pref) - int(b.Pref) })
+
+	return mxs, nil
+}
+
+// Lookup IPv4 and IPv6 addresses of `host`
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	var addrs []net.IPAddr
+
+	a, _, errA := lookup[*dns.A](ctx, r, host, dns.TypeA)
+	for _, record := range a {
+		addrs = append(addrs, net.IPAddr{IP: record.A})
+	}
+
+	aaaa, _, errAAAA := lookup[*dns.AAAA](ctx, r, host, dns.TypeAAAA)
+	for _, record := range aaaa {
+		addrs = append(addrs, net.IPAddr{IP: record.AAAA})
+	}
+
+	if len(addrs) == 0 {
+		// Prefer reporting temporary failures over missing records
+		var dnsErr *net.DNSError
+		if errors.As(errA, &dnsErr) && !dnsErr.IsNotFound {
+			return nil, errA
+		}
+		return nil, errAAAA
+	}
+
+	return addrs, nil
+}
+
+// Lookup the names pointing to `addr` (reverse lookup)
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+
+	records, _, err := lookup[*dns.PTR](ctx, r, reverse, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(records))
+	for _, record := range records {
+		names = append(names, record.Ptr)
+	}
+
+	return names, nil
+}
+
+// Lookup TLSA records of `name`
+//
+// Also reports whether the answer was DNSSEC authenticated by the nameserver.
+// A missing record is not an error.
+func (r *Resolver) LookupTLSA(ctx context.Context, name string) ([]*dns.TLSA, bool, error) {
+	records, resp, err := lookup[*dns.TLSA](ctx, r, name, dns.TypeTLSA)
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, resp.AuthenticatedData, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return records, resp.AuthenticatedData, nil
+}
+
+// Adapter for APIs expecting a lookup function without context
+//
+// The query is bounded by the resolver timeout only.
+func (r *Resolver) LookupTXTFunc() func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return r.LookupTXT(context.Background(), name)
+	}
+}
+
+// Check whether `err` is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
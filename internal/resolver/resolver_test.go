@@ -0,0 +1,163 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/coronon/pingpong-mail/internal/resolver/resolvertest"
+)
+
+// In-process nameserver counting the queries it receives per name
+type stubServer struct {
+	addr string
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (s *stubServer) count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queries[name]
+}
+
+// Start a nameserver serving a fixed zone below "example.com."
+func startStub(t *testing.T) *stubServer {
+	t.Helper()
+
+	stub := &stubServer{queries: make(map[string]int)}
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 120,
+	}
+
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		stub.mu.Lock()
+		stub.queries[q.Name]++
+		stub.mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+
+		switch {
+		case q.Name == "txt.example.com." && q.Qtype == dns.TypeTXT:
+			hdr.Ttl = 300
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"v=spf1 ", "-all"}})
+		case q.Name == "short.example.com." && q.Qtype == dns.TypeTXT:
+			hdr.Ttl = 0
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"uncached"}})
+		case q.Name == "txt.example.com.":
+			// Name exists, but has no records of this type (NODATA)
+			resp.Ns = append(resp.Ns, soa)
+		case q.Name == "broken.example.com.":
+			resp.Rcode = dns.RcodeServerFailure
+		default:
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = append(resp.Ns, soa)
+		}
+
+		_ = w.WriteMsg(resp)
+	}
+
+	stub.addr = resolvertest.Start(t, handler)
+
+	return stub
+}
+
+func TestLookupTXTCache(t *testing.T) {
+	stub := startStub(t)
+	r := &Resolver{Servers: []string{stub.addr}, Timeout: time.Second, CacheSize: 16}
+	ctx := context.Background()
+
+	for range 3 {
+		txts, err := r.LookupTXT(ctx, "txt.example.com")
+		if err != nil {
+			t.Fatalf("LookupTXT: %v", err)
+		}
+		if len(txts) != 1 || txts[0] != "v=spf1 -all" {
+			t.Fatalf("LookupTXT = %q, want joined record", txts)
+		}
+	}
+	if n := stub.count("txt.example.com."); n != 1 {
+		t.Errorf("cached answer queried %v times, want 1", n)
+	}
+
+	// Answers with a TTL of zero must not be cached
+	for range 2 {
+		if _, err := r.LookupTXT(ctx, "short.example.com"); err != nil {
+			t.Fatalf("LookupTXT: %v", err)
+		}
+	}
+	if n := stub.count("short.example.com."); n != 2 {
+		t.Errorf("zero TTL answer queried %v times, want 2", n)
+	}
+
+	// Disabled cache always queries
+	uncached := &Resolver{Servers: []string{stub.addr}, Timeout: time.Second}
+	for range 2 {
+		if _, err := uncached.LookupTXT(ctx, "txt.example.com"); err != nil {
+			t.Fatalf("LookupTXT: %v", err)
+		}
+	}
+	if n := stub.count("txt.example.com."); n != 3 {
+		t.Errorf("answers queried %v times without cache, want 3", n)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	stub := startStub(t)
+	r := &Resolver{Servers: []string{stub.addr}, Timeout: time.Second, CacheSize: 16}
+	ctx := context.Background()
+
+	// Both NXDOMAIN and NODATA are reported as not found, like `net.Resolver`
+	for _, name := range []string{"missing.example.com", "txt.example.com"} {
+		for range 2 {
+			_, err := r.LookupMX(ctx, name)
+
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || dnsErr.IsTemporary {
+				t.Fatalf("LookupMX(%q) error = %#v, want not found", name, err)
+			}
+		}
+	}
+
+	// Negative answers are cached for the SOA minimum TTL
+	if n := stub.count("missing.example.com."); n != 1 {
+		t.Errorf("NXDOMAIN queried %v times, want 1", n)
+	}
+	key := cacheKey{"missing.example.com.", dns.TypeMX}
+	if ttl := time.Until(r.cache[key].expires); ttl <= 110*time.Second || ttl > 120*time.Second {
+		t.Errorf("NXDOMAIN cached for %v, want SOA minimum of 120s", ttl)
+	}
+}
+
+func TestServerFailure(t *testing.T) {
+	stub := startStub(t)
+	r := &Resolver{Servers: []string{stub.addr}, Timeout: time.Second, CacheSize: 16}
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := r.LookupTXT(ctx, "broken.example.com")
+
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+			t.Fatalf("LookupTXT error = %#v, want temporary failure", err)
+		}
+	}
+
+	// Failures are not cached
+	if n := stub.count("broken.example.com."); n != 2 {
+		t.Errorf("SERVFAIL queried %v times, want 2", n)
+	}
+}
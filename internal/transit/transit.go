@@ -0,0 +1,172 @@
+package transit
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Host names in the `from` and `by` clauses of a Received header
+var (
+	fromRegex = regexp.MustCompile(`(?i)(?:^|\s)from\s+([^\s;()]+)`)
+	byRegex   = regexp.MustCompile(`(?i)(?:^|\s)by\s+([^\s;()]+)`)
+)
+
+// Single relay an email passed through
+type Hop struct {
+	// Host the relay received the email from, as claimed by the relay
+	From string
+	// Host of the relay
+	By string
+	// Time the relay received the email
+	Time time.Time
+	// Time since the previous hop (or the Date header for the first hop)
+	//
+	// Negative delays indicate clock skew between the relays.
+	Delay time.Duration
+}
+
+// Time an email took from its author to us
+type Transit struct {
+	// Date header of the email, zero if missing or invalid
+	Sent time.Time
+	// Relays the email passed through, oldest first, ending with us
+	Hops []Hop
+	// Time from Date (or the first hop if unknown) until we received the email
+	Total time.Duration
+}
+
+// Measure the transit of an email with `header`, received by `by` at `received`
+//
+// Received headers (RFC 5321 §4.4) without a valid timestamp are skipped.
+func Measure(header mail.Header, by string, received time.Time) *Transit {
+	t := &Transit{}
+
+	if sent, err := mail.ParseDate(header.Get("Date")); err == nil {
+		t.Sent = sent
+	}
+
+	//? Each relay prepends its header, so the oldest one comes last
+	fields := header["Received"]
+	for i := len(fields) - 1; i >= 0; i-- {
+		if hop, ok := parseReceived(fields[i]); ok {
+			t.Hops = append(t.Hops, hop)
+		}
+	}
+	t.Hops = append(t.Hops, Hop{By: by, Time: received})
+	if len(t.Hops) > 1 && t.Hops[len(t.Hops)-1].From == "" {
+		t.Hops[len(t.Hops)-1].From = t.Hops[len(t.Hops)-2].By
+	}
+
+	previous := t.Sent
+	for i := range t.Hops {
+		if !previous.IsZero() {
+			t.Hops[i].Delay = t.Hops[i].Time.Sub(previous)
+		}
+		previous = t.Hops[i].Time
+	}
+
+	start := t.Sent
+	if start.IsZero() {
+		start = t.Hops[0].Time
+	}
+	t.Total = received.Sub(start)
+
+	return t
+}
+
+// Parse a single Received header field
+func parseReceived(field string) (Hop, bool) {
+	//? The timestamp follows the last semicolon
+	idx := strings.LastIndexByte(field, ';')
+	if idx < 0 {
+		return Hop{}, false
+	}
+
+	received, err := mail.ParseDate(strings.TrimSpace(field[idx+1:]))
+	if err != nil {
+		return Hop{}, false
+	}
+
+	hop := Hop{Time: received}
+	//? Comments like `(Postfix, from userid 1000)` would be taken for clauses
+	clauses := strings.Join(strings.Fields(stripComments(field[:idx])), " ")
+	if match := fromRegex.FindStringSubmatch(clauses); match != nil {
+		hop.From = match[1]
+	}
+	if match := byRegex.FindStringSubmatch(clauses); match != nil {
+		hop.By = match[1]
+	}
+
+	return hop, true
+}
+
+// Remove all (possibly nested) comments from `field`
+func stripComments(field string) string {
+	b := new(strings.Builder)
+	depth := 0
+
+	for i := 0; i < len(field); i++ {
+		switch c := field[i]; {
+		case c == '\\' && depth > 0:
+			// Quoted pair, skip the escaped character
+			i++
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+			b.WriteByte(' ')
+		case depth == 0:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Human readable table of all hops and their delays
+func (t *Transit) String() string {
+	b := new(strings.Builder)
+
+	if !t.Sent.IsZero() {
+		fmt.Fprintf(b, "Sent:  %v\n", t.Sent.UTC().Format(time.RFC3339))
+	}
+	for i, hop := range t.Hops {
+		sign := "+"
+		if hop.Delay < 0 {
+			sign = ""
+		}
+		fmt.Fprintf(b, "Hop %v: %v -> %v at %v (%v%v)\n",
+			i+1,
+			defaultHost(hop.From),
+			defaultHost(hop.By),
+			hop.Time.UTC().Format(time.RFC3339),
+			sign,
+			hop.Delay.Round(time.Millisecond),
+		)
+	}
+	fmt.Fprintf(b, "Total: %v\n", t.Total.Round(time.Millisecond))
+
+	return b.String()
+}
+
+// Fields of the hops suitable for structured logging
+func (t *Transit) LogHops() []string {
+	hops := make([]string, 0, len(t.Hops))
+	for _, hop := range t.Hops {
+		hops = append(hops, fmt.Sprintf("%v %v", defaultHost(hop.By), hop.Delay.Round(time.Millisecond)))
+	}
+
+	return hops
+}
+
+// `host` or a placeholder if it is unknown
+func defaultHost(host string) string {
+	if host == "" {
+		return "?"
+	}
+
+	return host
+}
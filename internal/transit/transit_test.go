@@ -0,0 +1,98 @@
+package transit
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReceived(t *testing.T) {
+	date := time.Date(2026, 10, 12, 10, 0, 5, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		field string
+		want  Hop
+		ok    bool
+	}{
+		{
+			"postfix",
+			"from mail.example.com (mail.example.com [192.0.2.1])\r\n\tby mx.test (Postfix) with ESMTPS id 4F2;\r\n\tMon, 12 Oct 2026 10:00:05 +0000 (UTC)",
+			Hop{From: "mail.example.com", By: "mx.test", Time: date},
+			true,
+		},
+		{
+			"local submission",
+			"by localhost (Postfix, from userid 1000) id 4F2; Mon, 12 Oct 2026 10:00:05 +0000",
+			Hop{By: "localhost", Time: date},
+			true,
+		},
+		{
+			"nested comments",
+			"from a.example.com (authenticated (by b.example.com\\)) by c.example.com) by mx.test; Mon, 12 Oct 2026 12:00:05 +0200",
+			Hop{From: "a.example.com", By: "mx.test", Time: date},
+			true,
+		},
+		{
+			"upper case clauses",
+			"FROM a.example.com BY mx.test FOR <check@mx.test>; 12 Oct 2026 10:00:05 GMT",
+			Hop{From: "a.example.com", By: "mx.test", Time: date},
+			true,
+		},
+		{"no timestamp", "from a.example.com by mx.test", Hop{}, false},
+		{"invalid timestamp", "from a.example.com by mx.test; yesterday", Hop{}, false},
+	}
+
+	for _, test := range tests {
+		hop, ok := parseReceived(test.field)
+		if ok != test.ok || hop.From != test.want.From || hop.By != test.want.By || !hop.Time.Equal(test.want.Time) {
+			t.Errorf("%v: parseReceived = %+v, %v, want %+v, %v", test.name, hop, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	received := time.Date(2026, 10, 12, 10, 0, 6, 0, time.UTC)
+	header := mail.Header{
+		"Date": {"Mon, 12 Oct 2026 10:00:00 +0000"},
+		// Newest first, as prepended by each relay
+		"Received": {
+			"from mx1.example.com by mx2.example.com; Mon, 12 Oct 2026 10:00:05 +0000",
+			"from client by mx1.example.com; garbage",
+			"from client by mx1.example.com; Mon, 12 Oct 2026 10:00:02 +0000",
+		},
+	}
+
+	transit := Measure(header, "mail.test", received)
+
+	want := []Hop{
+		{From: "client", By: "mx1.example.com", Delay: 2 * time.Second},
+		{From: "mx1.example.com", By: "mx2.example.com", Delay: 3 * time.Second},
+		{From: "mx2.example.com", By: "mail.test", Delay: time.Second},
+	}
+	got := make([]Hop, len(transit.Hops))
+	for i, hop := range transit.Hops {
+		got[i] = Hop{From: hop.From, By: hop.By, Delay: hop.Delay}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Hops = %+v, want %+v", got, want)
+	}
+	if transit.Total != 6*time.Second {
+		t.Errorf("Total = %v, want 6s", transit.Total)
+	}
+
+	// Without a Date header the first hop starts the transit
+	delete(header, "Date")
+	transit = Measure(header, "mail.test", received)
+	if transit.Hops[0].Delay != 0 || transit.Total != 4*time.Second {
+		t.Errorf("without Date: first delay %v, total %v, want 0s and 4s", transit.Hops[0].Delay, transit.Total)
+	}
+
+	// Clock skew between relays results in negative delays
+	header = mail.Header{"Date": {"Mon, 12 Oct 2026 10:00:10 +0000"}}
+	transit = Measure(header, "mail.test", received)
+	if len(transit.Hops) != 1 || transit.Hops[0].From != "" || transit.Hops[0].Delay != -4*time.Second {
+		t.Errorf("skewed: Hops = %+v, want a single hop delayed by -4s", transit.Hops)
+	}
+}
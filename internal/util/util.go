@@ -1,11 +1,14 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/mail"
 	"strings"
 
 	"github.com/coronon/pingpong-mail/internal/config"
+	"github.com/coronon/pingpong-mail/internal/resolver"
 	"go.uber.org/zap"
 )
 
@@ -39,25 +42,60 @@ func GetRawFromHeaderAddress(fromHeader string) (string, error) {
 }
 
 // Lookup MX records for `domain`, sorted by preference
-func GetMXDomains(domain string) []*net.MX {
+//
+// Domains without MX records fall back to the implicit MX of the domain itself
+// if it has address records (RFC 5321 section 5.1). A null MX (RFC 7505)
+// results in `config.ErrNullMX`, a domain with neither MX nor address records
+// in `config.ErrNoMailHost`.
+func GetMXDomains(ctx context.Context, domain string) ([]*net.MX, error) {
 	zap.S().Debugw("Looking up MX records", "domain", domain)
 
-	mxRecords, err := net.LookupMX(domain)
+	mxRecords, err := resolver.Default.LookupMX(ctx, domain)
+	if isNotFound(err) || (err == nil && len(mxRecords) == 0) {
+		zap.S().Debugw("No MX records found, trying implicit MX", "domain", domain)
+
+		_, err := resolver.Default.LookupIPAddr(ctx, domain)
+		if isNotFound(err) {
+			zap.S().Infow("No MX or address records found", "domain", domain)
+			return nil, config.ErrNoMailHost
+		}
+		if err != nil {
+			zap.S().Infow("Can't lookup address records", "domain", domain, "error", err)
+			return nil, err
+		}
+
+		return []*net.MX{{Host: domain, Pref: 0}}, nil
+	}
 	if err != nil {
-		zap.S().Infow("Can't lookup MX records", "domain", domain)
-		return make([]*net.MX, 0)
+		zap.S().Infow("Can't lookup MX records", "domain", domain, "error", err)
+		return nil, err
+	}
+
+	// Null MX records must be the only record of a domain, but be lenient and
+	// only ignore them when there are other hosts
+	hosts := make([]*net.MX, 0, len(mxRecords))
+	for _, mx := range mxRecords {
+		if mx.Host != "." && mx.Host != "" {
+			hosts = append(hosts, mx)
+		}
 	}
-	if len(mxRecords) == 0 {
-		zap.S().Infow("No MX records found", "domain", domain)
-		return mxRecords
+	if len(hosts) == 0 {
+		zap.S().Infow("Domain does not accept mail (null MX)", "domain", domain)
+		return nil, config.ErrNullMX
 	}
 
 	zap.S().Debugw("Found MX records",
 		"domain", domain,
-		"records", mxRecords,
+		"records", hosts,
 	)
 
-	return mxRecords
+	return hosts, nil
+}
+
+// Check whether `err` is a DNS error reporting that the record does not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
 }
 
 // Used to pipe normal log.Logger output into the zap logger
@@ -1,6 +1,7 @@
 package mailyak
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ type attachment struct {
 	content  io.Reader
 	inline   bool
 	mimeType string
+	message  bool
 }
 
 // Attach adds the contents of r to the email as an attachment with name as the
@@ -92,6 +94,24 @@ func (m *MailYak) AttachInlineWithMimeType(name string, r io.Reader, mimeType st
 	})
 }
 
+// AttachMessage adds the contents of r to the email as a message/rfc822
+// attachment with name as the filename.
+//
+// r must contain a complete email including its headers. As required by RFC
+// 2046 section 5.2.1 it is not transfer encoded, line endings are normalised
+// to CRLF.
+//
+// r is not read until Send is called.
+func (m *MailYak) AttachMessage(name string, r io.Reader) {
+	m.attachments = append(m.attachments, attachment{
+		filename: name,
+		content:  r,
+		inline:   false,
+		mimeType: "message/rfc822",
+		message:  true,
+	})
+}
+
 // ClearAttachments removes all current attachments.
 func (m *MailYak) ClearAttachments() {
 	m.attachments = []attachment{}
@@ -103,6 +123,13 @@ func (m *MailYak) writeAttachments(mixed partCreator, splitter writeWrapper) err
 	h := make([]byte, sniffLen)
 
 	for _, item := range m.attachments {
+		if item.message {
+			if err := writeMessageAttachment(mixed, item); err != nil {
+				return err
+			}
+			continue
+		}
+
 		hLen, err := io.ReadFull(item.content, h)
 		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
@@ -139,6 +166,38 @@ func (m *MailYak) writeAttachments(mixed partCreator, splitter writeWrapper) err
 	return nil
 }
 
+// writeMessageAttachment writes the email attached as item without transfer
+// encoding, as 8bit if it contains any non-ASCII bytes.
+func writeMessageAttachment(mixed partCreator, item attachment) error {
+	data, err := io.ReadAll(item.content)
+	if err != nil {
+		return err
+	}
+
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	encoding := "7bit"
+	for _, b := range data {
+		if b >= 0x80 {
+			encoding = "8bit"
+			break
+		}
+	}
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {item.mimeType},
+		"Content-Disposition":       {fmt.Sprintf("attachment;\n\tfilename=%q", item.filename)},
+		"Content-Transfer-Encoding": {encoding},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = part.Write(data)
+	return err
+}
+
 func getMIMEHeader(a attachment, ctype string) textproto.MIMEHeader {
 	var disp string
 	var header textproto.MIMEHeader
@@ -10,6 +10,7 @@ import (
 	"mime/quotedprintable"
 	"net/textproto"
 	"strings"
+	"unicode/utf8"
 )
 
 func (m *MailYak) buildMime(w io.Writer) error {
@@ -97,7 +98,7 @@ func (m *MailYak) writeHeaders(w io.Writer) error {
 		fmt.Fprintf(w, "Reply-To: %s\r\n", m.replyTo)
 	}
 
-	fmt.Fprintf(w, "Subject: %s\r\n", m.subject)
+	fmt.Fprintf(w, "Subject: %s\r\n", encodeHeader("Subject", m.subject))
 
 	if len(m.toAddrs) > 0 {
 		commaSeparatedToAddrs := strings.Join(m.toAddrs, ",")
@@ -133,6 +134,72 @@ func (m *MailYak) fromHeader() string {
 	return fmt.Sprintf("From: %s <%s>\r\n", m.fromName, m.fromAddr)
 }
 
+// encodeHeader Q-encodes value as RFC 2047 encoded-words if it contains
+// non-ASCII characters.
+//
+// Unlike mime.QEncoding, the encoded-words are folded onto multiple lines so
+// that no line of the name header exceeds 76 characters (RFC 2047 section 2).
+// Values that need no encoding are returned as is.
+func encodeHeader(name, value string) string {
+	const prefix, suffix = "=?UTF-8?q?", "?="
+
+	if !needsEncoding(value) {
+		return value
+	}
+
+	var b strings.Builder
+	var word strings.Builder
+
+	// Space left on the first line after "Name: "
+	room := 76 - len(name) - len(": ")
+	for _, r := range value {
+		encoded := qEncodeRune(r)
+
+		// Runes are never split across encoded-words
+		if word.Len() > 0 && len(prefix)+word.Len()+len(encoded)+len(suffix) > room {
+			b.WriteString(prefix + word.String() + suffix + "\r\n ")
+			word.Reset()
+			// Continuation lines start with a single space
+			room = 75
+		}
+
+		word.WriteString(encoded)
+	}
+	b.WriteString(prefix + word.String() + suffix)
+
+	return b.String()
+}
+
+// needsEncoding reports whether s contains characters that can't appear in a
+// header unencoded.
+func needsEncoding(s string) bool {
+	for _, b := range []byte(s) {
+		if (b < ' ' || b > '~') && b != '\t' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// qEncodeRune returns the "Q" encoding of r (RFC 2047 section 4.2).
+func qEncodeRune(r rune) string {
+	switch {
+	case r == ' ':
+		return "_"
+	case r > ' ' && r <= '~' && r != '=' && r != '?' && r != '_':
+		return string(r)
+	}
+
+	var b strings.Builder
+	var buf [utf8.UTFMax]byte
+	for _, c := range buf[:utf8.EncodeRune(buf[:], r)] {
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+
+	return b.String()
+}
+
 // writeBody writes the text/plain and text/html mime parts.
 func (m *MailYak) writeBody(w io.Writer, boundary string) error {
 	if m.plain.Len() == 0 && m.html.Len() == 0 {
@@ -0,0 +1,59 @@
+package mailyak
+
+import (
+	"mime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEncodeHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"ascii", "PONG - 'PING hello'"},
+		{"latin", "Grüße aus München"},
+		{"special characters", "Ä = ? _ =?UTF-8?q?x?="},
+		{"cjk", strings.Repeat("日本語のテキスト", 12)},
+		{"emoji", strings.Repeat("🏓 ping pong ", 15)},
+		{"long word", strings.Repeat("ä", 200)},
+	}
+
+	dec := new(mime.WordDecoder)
+	for _, tt := range tests {
+		got := encodeHeader("Subject", tt.value)
+
+		if !needsEncoding(tt.value) {
+			if got != tt.value {
+				t.Errorf("%v: encodeHeader = %q, want unchanged", tt.name, got)
+			}
+			continue
+		}
+
+		lines := strings.Split(got, "\r\n")
+		var decoded strings.Builder
+		for i, line := range lines {
+			length := len(line)
+			if i == 0 {
+				length += len("Subject: ")
+			} else if !strings.HasPrefix(line, " ") || strings.HasPrefix(line, "  ") {
+				t.Errorf("%v: continuation line %q must start with a single space", tt.name, line)
+			}
+			if length > 76 {
+				t.Errorf("%v: line %q is %v characters long, want at most 76", tt.name, line, length)
+			}
+
+			// Every encoded-word must decode on its own, runes are never split
+			word, err := dec.Decode(strings.TrimPrefix(line, " "))
+			if err != nil || !utf8.ValidString(word) {
+				t.Errorf("%v: invalid encoded-word %q: %v", tt.name, line, err)
+			}
+			decoded.WriteString(word)
+		}
+
+		if decoded.String() != tt.value {
+			t.Errorf("%v: decoded %q, want %q", tt.name, decoded.String(), tt.value)
+		}
+	}
+}
@@ -132,9 +132,10 @@ func (m *MailYak) ReplyTo(addr string) {
 
 // Subject sets the email subject line.
 //
-// If sub contains non-ASCII characters, it is Q-encoded according to RFC1342.
+// If sub contains non-ASCII characters, it is Q-encoded according to RFC 2047
+// and folded onto multiple lines when the message is built.
 func (m *MailYak) Subject(sub string) {
-	m.subject = mime.QEncoding.Encode("UTF-8", m.trimRegex.ReplaceAllString(sub, ""))
+	m.subject = m.trimRegex.ReplaceAllString(sub, "")
 }
 
 // AddHeader adds an arbitrary email header.